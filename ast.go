@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// AST
+
+// node is an element of a File or a block body
+type node interface {
+	kind() string
+}
+
+// body is an ordered list of nodes. Order is preserved so that comments
+// stay next to the declarations they describe.
+type body []node
+
+// MarshalJSON tags each node with its kind
+func (b body) MarshalJSON() ([]byte, error) {
+	out := []json.RawMessage{}
+	for _, n := range b {
+		j, err := json.Marshal(n)
+		if err != nil {
+			return nil, err
+		}
+		k, err := json.Marshal(map[string]string{"kind": n.kind()})
+		if err != nil {
+			return nil, err
+		}
+		// splice the kind into the start of the object
+		k = k[:len(k)-1]
+		if len(j) > 2 {
+			k = append(append(k, ','), j[1:]...)
+		} else {
+			k = append(k, '}')
+		}
+		out = append(out, k)
+	}
+	return json.Marshal(out)
+}
+
+// File is a parsed preto file
+type File struct {
+	Body body `json:"body"`
+
+	// disabled holds the lint rules disabled on each line
+	disabled map[int][]string
+	// warnings are problems found while parsing which aren't errors
+	warnings []string
+	// lines maps lines back to the files they were included from
+	lines lineMap
+}
+
+// Syntax is a syntax declaration
+type Syntax struct {
+	Value string `json:"value"`
+}
+
+// Edition is an edition declaration, which replaces syntax
+type Edition struct {
+	Value string `json:"value"`
+}
+
+// Package is a package declaration
+type Package struct {
+	Name string `json:"name"`
+}
+
+// Import is an import statement
+type Import struct {
+	Path string `json:"path"`
+	// Modifier is public or weak, if set
+	Modifier string `json:"modifier,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+
+	// auto is set for imports added by preto
+	auto bool
+}
+
+// Option is a file level option
+type Option struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	Comment string `json:"comment,omitempty"`
+
+	// auto is set for options added by preto
+	auto bool
+}
+
+// Blank is an empty toplevel line
+type Blank struct{}
+
+// Comment is a comment on a line of its own
+type Comment struct {
+	Text string `json:"text"`
+}
+
+// Raw is proto passed through to the output as written
+type Raw struct {
+	Text string `json:"text"`
+}
+
+// Message is a message declaration
+type Message struct {
+	Name       string `json:"name"`
+	Comment    string `json:"comment,omitempty"`
+	Body       body   `json:"body"`
+	EndComment string `json:"endComment,omitempty"`
+
+	line int
+}
+
+// Field is a message or oneof field. Options are kept in the order they
+// are written and a name may appear more than once, e.g. for repeated
+// custom options.
+type Field struct {
+	Name    string         `json:"name"`
+	Label   string         `json:"label,omitempty"`
+	Type    string         `json:"type"`
+	Number  int            `json:"number"`
+	Options []*FieldOption `json:"options,omitempty"`
+	Comment string         `json:"comment,omitempty"`
+
+	// inferred is set if the label was not given explicitly
+	inferred bool
+	line     int
+}
+
+// FieldOption is a single option in a field's option list
+type FieldOption struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Reserved is a list of reserved field numbers or names
+type Reserved struct {
+	Ranges  []*Range `json:"ranges,omitempty"`
+	Names   []string `json:"names,omitempty"`
+	Comment string   `json:"comment,omitempty"`
+
+	line int
+}
+
+// Extensions is a list of field numbers available for extensions
+type Extensions struct {
+	Ranges  []*Range `json:"ranges"`
+	Comment string   `json:"comment,omitempty"`
+}
+
+// Range is an inclusive range of field numbers. If Max is set the range
+// extends to the maximum field number.
+type Range struct {
+	Start int  `json:"start"`
+	End   int  `json:"end,omitempty"`
+	Max   bool `json:"max,omitempty"`
+}
+
+// Enum is an enum declaration
+type Enum struct {
+	Name       string `json:"name"`
+	Comment    string `json:"comment,omitempty"`
+	Body       body   `json:"body"`
+	EndComment string `json:"endComment,omitempty"`
+
+	line int
+}
+
+// EnumValue is a value in an enum
+type EnumValue struct {
+	Name    string `json:"name"`
+	Number  int    `json:"number"`
+	Comment string `json:"comment,omitempty"`
+
+	line int
+}
+
+// Oneof is a oneof declaration
+type Oneof struct {
+	Name       string `json:"name"`
+	Comment    string `json:"comment,omitempty"`
+	Body       body   `json:"body"`
+	EndComment string `json:"endComment,omitempty"`
+
+	line int
+}
+
+// Service is a service declaration
+type Service struct {
+	Name       string `json:"name"`
+	Comment    string `json:"comment,omitempty"`
+	Body       body   `json:"body"`
+	EndComment string `json:"endComment,omitempty"`
+
+	line int
+}
+
+// RPC is a method in a service
+type RPC struct {
+	Name           string `json:"name"`
+	Request        string `json:"request"`
+	RequestStream  bool   `json:"requestStream,omitempty"`
+	Response       string `json:"response"`
+	ResponseStream bool   `json:"responseStream,omitempty"`
+	Comment        string `json:"comment,omitempty"`
+
+	line int
+}
+
+// contains returns whether n is in the range
+func (r *Range) contains(n int) bool {
+	return n >= r.Start && (r.Max || n <= r.End)
+}
+
+func (*Blank) kind() string      { return "blank" }
+func (*Syntax) kind() string     { return "syntax" }
+func (*Edition) kind() string    { return "edition" }
+func (*Package) kind() string    { return "package" }
+func (*Import) kind() string     { return "import" }
+func (*Option) kind() string     { return "option" }
+func (*Comment) kind() string    { return "comment" }
+func (*Raw) kind() string        { return "raw" }
+func (*Message) kind() string    { return "message" }
+func (*Field) kind() string      { return "field" }
+func (*Reserved) kind() string   { return "reserved" }
+func (*Extensions) kind() string { return "extensions" }
+func (*Enum) kind() string       { return "enum" }
+func (*EnumValue) kind() string  { return "value" }
+func (*Oneof) kind() string      { return "oneof" }
+func (*Service) kind() string    { return "service" }
+func (*RPC) kind() string        { return "rpc" }
+
+// Warnings returns the problems found while parsing the file which
+// didn't stop it being converted
+func (f *File) Warnings() []string {
+	return f.warnings
+}
+
+// imports returns the paths of all imports in the file
+func (f *File) imports() []string {
+	imports := []string{}
+	for _, n := range f.Body {
+		if i, ok := n.(*Import); ok {
+			imports = append(imports, i.Path)
+		}
+	}
+	return imports
+}
+
+// userImports is like imports but leaves out the imports of well-known
+// types which preto added
+func (f *File) userImports() []string {
+	imports := []string{}
+	for _, n := range f.Body {
+		if i, ok := n.(*Import); ok && !i.auto {
+			imports = append(imports, i.Path)
+		}
+	}
+	return imports
+}
+
+// pkg returns the package name of the file, or "" if it has none
+func (f *File) pkg() string {
+	for _, n := range f.Body {
+		if p, ok := n.(*Package); ok {
+			return p.Name
+		}
+	}
+	return ""
+}
+
+// typeRefs returns the types referred to by fields and rpcs in the file.
+// For maps the value type is returned.
+func (f *File) typeRefs() []string {
+	refs := []string{}
+	walk(f.Body, func(n node) {
+		switch n := n.(type) {
+		case *Field:
+			t := n.Type
+			if strings.HasPrefix(t, "map<") {
+				t = strings.TrimSpace(t[strings.Index(t, ",")+1 : len(t)-1])
+			}
+			refs = append(refs, t)
+		case *RPC:
+			refs = append(refs, n.Request, n.Response)
+		}
+	})
+	return refs
+}
+
+// walk calls fn for each node in b, recursing into blocks
+func walk(b body, fn func(node)) {
+	for _, n := range b {
+		fn(n)
+		switch n := n.(type) {
+		case *Message:
+			walk(n.Body, fn)
+		case *Enum:
+			walk(n.Body, fn)
+		case *Oneof:
+			walk(n.Body, fn)
+		case *Service:
+			walk(n.Body, fn)
+		}
+	}
+}
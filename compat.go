@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	protoCommentRegexp = regexp.MustCompile(`//.*|(?s:/\*.*?\*/)`)
+	protoItemRegexp    = regexp.MustCompile(`"(\\.|[^"\\])*"|[A-Za-z_][\w.]*|-?(0[xX][0-9a-fA-F]+|[0-9]+)|[{};=<>,\[\]]`)
+)
+
+// parseProto reads the messages, fields and reserved statements of
+// proto source into a File, which is as much of it as compat needs.
+// Everything else, such as enums, services and options, is skipped.
+func parseProto(src string) (*File, error) {
+	src = protoCommentRegexp.ReplaceAllString(src, " ")
+	tokens := protoItemRegexp.FindAllString(src, -1)
+	f := &File{}
+	// each open brace pushes the body its statements go in, or nil for
+	// blocks which are skipped
+	stack := []*body{&f.Body}
+	stmt := []string{}
+	for _, tok := range tokens {
+		switch tok {
+		case "{":
+			var b *body
+			if len(stmt) == 2 && stack[len(stack)-1] != nil {
+				switch stmt[0] {
+				case "message":
+					m := &Message{Name: stmt[1]}
+					*stack[len(stack)-1] = append(*stack[len(stack)-1], m)
+					b = &m.Body
+				case "oneof":
+					o := &Oneof{Name: stmt[1]}
+					*stack[len(stack)-1] = append(*stack[len(stack)-1], o)
+					b = &o.Body
+				}
+			}
+			stack = append(stack, b)
+			stmt = []string{}
+		case "}":
+			if len(stack) == 1 {
+				return nil, fmt.Errorf("unexpected }")
+			}
+			stack = stack[:len(stack)-1]
+			stmt = []string{}
+		case ";":
+			if b := stack[len(stack)-1]; b != nil && len(stack) > 1 {
+				n, err := protoStatement(stmt)
+				if err != nil {
+					return nil, err
+				}
+				if n != nil {
+					*b = append(*b, n)
+				}
+			}
+			stmt = []string{}
+		default:
+			stmt = append(stmt, tok)
+		}
+	}
+	if len(stack) != 1 {
+		return nil, fmt.Errorf("missing }")
+	}
+	return f, nil
+}
+
+// protoStatement converts a statement in a message or oneof to a Field
+// or Reserved node, or returns nil for other statements
+func protoStatement(stmt []string) (node, error) {
+	if len(stmt) == 0 {
+		return nil, nil
+	}
+	switch stmt[0] {
+	case "option", "extensions", "extend":
+		return nil, nil
+	case "reserved":
+		r := &Reserved{}
+		for i := 1; i < len(stmt); i++ {
+			tok := stmt[i]
+			switch {
+			case tok == ",":
+			case strings.HasPrefix(tok, `"`):
+				name, err := strconv.Unquote(tok)
+				if err != nil {
+					return nil, err
+				}
+				r.Names = append(r.Names, name)
+			default:
+				start, err := strconv.ParseInt(tok, 0, 32)
+				if err != nil {
+					return nil, fmt.Errorf("invalid reserved number %s", tok)
+				}
+				rg := &Range{Start: int(start), End: int(start)}
+				if i+2 < len(stmt) && stmt[i+1] == "to" {
+					if stmt[i+2] == "max" {
+						rg.Max = true
+					} else if end, err := strconv.ParseInt(stmt[i+2], 0, 32); err == nil {
+						rg.End = int(end)
+					} else {
+						return nil, fmt.Errorf("invalid reserved range end %s", stmt[i+2])
+					}
+					i += 2
+				}
+				r.Ranges = append(r.Ranges, rg)
+			}
+		}
+		return r, nil
+	}
+
+	// [label] type name = number [options]
+	f := &Field{}
+	i := 0
+	switch stmt[0] {
+	case "optional", "required", "repeated":
+		f.Label = stmt[0]
+		i++
+	}
+	if i < len(stmt) && stmt[i] == "map" {
+		j := i
+		for j < len(stmt) && stmt[j] != ">" {
+			j++
+		}
+		f.Type = strings.Join(stmt[i:j+1], "")
+		i = j + 1
+	} else if i < len(stmt) {
+		f.Type = stmt[i]
+		i++
+	}
+	if i+2 >= len(stmt) || stmt[i+1] != "=" {
+		return nil, fmt.Errorf("can't read field %s", strings.Join(stmt, " "))
+	}
+	f.Name = stmt[i]
+	number, err := strconv.ParseInt(stmt[i+2], 0, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid field number %s", stmt[i+2])
+	}
+	f.Number = int(number)
+	return f, nil
+}
+
+// compatibleTypes are groups of scalar types which can be changed into
+// one another without breaking the wire format
+var compatibleTypes = map[string]string{
+	"int32": "varint", "uint32": "varint", "int64": "varint", "uint64": "varint", "bool": "varint",
+	"sint32": "zigzag", "sint64": "zigzag",
+	"string": "length", "bytes": "length",
+	"fixed32": "fixed32", "sfixed32": "fixed32",
+	"fixed64": "fixed64", "sfixed64": "fixed64",
+}
+
+// compatMessage is a message flattened for comparison, with the fields
+// of its oneofs
+type compatMessage struct {
+	fields   []*Field
+	reserved []*Reserved
+}
+
+// compatMessages returns the messages in f keyed by their name, which
+// is qualified by the messages they are nested in but not the package,
+// so that moving to a new package doesn't hide every change
+func compatMessages(f *File) map[string]*compatMessage {
+	msgs := map[string]*compatMessage{}
+	var collect func(scope string, b body)
+	collect = func(scope string, b body) {
+		for _, n := range b {
+			m, ok := n.(*Message)
+			if !ok {
+				continue
+			}
+			name := scopedName(scope, m.Name)
+			cm := &compatMessage{}
+			for _, n := range m.Body {
+				switch n := n.(type) {
+				case *Field:
+					cm.fields = append(cm.fields, n)
+				case *Oneof:
+					for _, o := range n.Body {
+						if f, ok := o.(*Field); ok {
+							cm.fields = append(cm.fields, f)
+						}
+					}
+				case *Reserved:
+					cm.reserved = append(cm.reserved, n)
+				}
+			}
+			msgs[name] = cm
+			collect(name, m.Body)
+		}
+	}
+	collect("", f.Body)
+	return msgs
+}
+
+// compat returns the changes from prev to next which break the wire
+// compatibility of messages: fields removed without reserving their
+// number, and fields whose number, type or label changed
+func compat(prev, next *File) []string {
+	problems := []string{}
+	oldMsgs, newMsgs := compatMessages(prev), compatMessages(next)
+	names := []string{}
+	for name := range oldMsgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		o, ok := newMsgs[name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("message %s was removed", name))
+			continue
+		}
+		for _, was := range oldMsgs[name].fields {
+			problems = append(problems, compatField(name, was, o)...)
+		}
+	}
+	return problems
+}
+
+// compatField compares a field of the old version of a message with the
+// new version
+func compatField(msg string, was *Field, m *compatMessage) []string {
+	var byNumber, byName *Field
+	for _, f := range m.fields {
+		if f.Number == was.Number {
+			byNumber = f
+		}
+		if f.Name == was.Name {
+			byName = f
+		}
+	}
+	problems := []string{}
+	if byName != nil && byName.Number != was.Number {
+		problems = append(problems, fmt.Sprintf("message %s: field %s changed number from %d to %d",
+			msg, was.Name, was.Number, byName.Number))
+	}
+	if byNumber == nil {
+		if !m.isReserved(was.Number) {
+			problems = append(problems, fmt.Sprintf("message %s: field %s (%d) was removed without reserving its number",
+				msg, was.Name, was.Number))
+		}
+		return problems
+	}
+	if !sameType(was.Type, byNumber.Type) {
+		problems = append(problems, fmt.Sprintf("message %s: field %d changed type from %s to %s",
+			msg, was.Number, was.Type, byNumber.Type))
+	}
+	if wasLabel, label := compatLabel(was), compatLabel(byNumber); wasLabel != label {
+		problems = append(problems, fmt.Sprintf("message %s: field %d changed from %s to %s",
+			msg, was.Number, wasLabel, label))
+	}
+	return problems
+}
+
+func (m *compatMessage) isReserved(n int) bool {
+	for _, r := range m.reserved {
+		for _, rg := range r.Ranges {
+			if rg.contains(n) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sameType returns whether a field's type can change from a to b. Names
+// of messages and enums match if one is a more qualified form of the
+// other.
+func sameType(a, b string) bool {
+	a = strings.ReplaceAll(strings.TrimPrefix(a, "."), " ", "")
+	b = strings.ReplaceAll(strings.TrimPrefix(b, "."), " ", "")
+	if a == b || strings.HasSuffix(a, "."+b) || strings.HasSuffix(b, "."+a) {
+		return true
+	}
+	group, ok := compatibleTypes[a]
+	return ok && group == compatibleTypes[b]
+}
+
+// compatLabel returns the label which matters on the wire: repeated,
+// required or optional, which includes fields without a label
+func compatLabel(f *Field) string {
+	switch {
+	case f.Label == "repeated", strings.HasPrefix(f.Type, "map<"):
+		return "repeated"
+	case f.Label == "required":
+		return "required"
+	}
+	return "optional"
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+)
+
+// config holds the settings for a conversion
+type config struct {
+	stripComments bool
+	commentChar   rune
+	strict        bool
+	sortFields    bool
+	typeMapper    func(string) string
+	maxDepth      int
+	style         string
+	trace         io.Writer
+	packRepeated  bool
+	header        string
+	warnFieldCost bool
+	exactComments bool
+	warnEmpty     bool
+	tabWidth      int
+	eol           string
+	noOptional    bool
+	requirePkg    bool
+	defaultPkg    string
+}
+
+// ConvertOption changes how a file is parsed or converted
+type ConvertOption func(*config)
+
+// WithStripComments omits comments from the output
+func WithStripComments() ConvertOption {
+	return func(c *config) { c.stripComments = true }
+}
+
+// WithCommentChar sets the character which starts a comment
+func WithCommentChar(ch rune) ConvertOption {
+	return func(c *config) { c.commentChar = ch }
+}
+
+// WithStrict rejects unindented lines which don't start with a keyword
+func WithStrict() ConvertOption {
+	return func(c *config) { c.strict = true }
+}
+
+// WithSortFields emits the fields of each message in field number order
+func WithSortFields() ConvertOption {
+	return func(c *config) { c.sortFields = true }
+}
+
+// WithTypeMapper sets a function which maps type names to proto types.
+// It is called for every field and rpc type; returning "" falls back to
+// the builtin shorthands such as str.
+func WithTypeMapper(fn func(string) string) ConvertOption {
+	return func(c *config) { c.typeMapper = fn }
+}
+
+// WithMaxDepth sets how deeply messages may be nested before parsing
+// fails. The default is 64.
+func WithMaxDepth(n int) ConvertOption {
+	return func(c *config) { c.maxDepth = n }
+}
+
+// WithStyle sets the name of the style to emit in, e.g. google
+func WithStyle(name string) ConvertOption {
+	return func(c *config) { c.style = name }
+}
+
+// WithTrace logs each parser call and token to w, for debugging
+func WithTrace(w io.Writer) ConvertOption {
+	return func(c *config) { c.trace = w }
+}
+
+// WithPackRepeated adds packed = true to repeated scalar fields in
+// proto2 files. proto3 packs them by default.
+func WithPackRepeated() ConvertOption {
+	return func(c *config) { c.packRepeated = true }
+}
+
+// WithHeader writes text as a comment at the top of the output
+func WithHeader(text string) ConvertOption {
+	return func(c *config) { c.header = text }
+}
+
+// WithWarnFieldNumberCost warns about repeated and map fields numbered
+// above 15, whose tags take two bytes. See File.Warnings.
+func WithWarnFieldNumberCost() ConvertOption {
+	return func(c *config) { c.warnFieldCost = true }
+}
+
+// WithExactComments keeps comments as written after the comment
+// character and one space, rather than trimming all leading spaces
+func WithExactComments() ConvertOption {
+	return func(c *config) { c.exactComments = true }
+}
+
+// WithWarnEmpty warns about messages, enums and oneofs with nothing in
+// them. See File.Warnings.
+func WithWarnEmpty() ConvertOption {
+	return func(c *config) { c.warnEmpty = true }
+}
+
+// WithTabWidth sets the number of columns a tab in indentation counts
+// as. The default is 4.
+func WithTabWidth(n int) ConvertOption {
+	return func(c *config) { c.tabWidth = n }
+}
+
+// WithCRLF ends lines in the output with \r\n instead of \n
+func WithCRLF() ConvertOption {
+	return func(c *config) { c.eol = "\r\n" }
+}
+
+// WithNoOptional leaves out the optional label of singular scalar fields
+// in proto2 unless it is written explicitly
+func WithNoOptional() ConvertOption {
+	return func(c *config) { c.noOptional = true }
+}
+
+// WithRequirePackage fails parsing if the file doesn't declare a
+// package
+func WithRequirePackage() ConvertOption {
+	return func(c *config) { c.requirePkg = true }
+}
+
+// WithDefaultPackage declares package name in files which don't declare
+// a package of their own
+func WithDefaultPackage(name string) ConvertOption {
+	return func(c *config) { c.defaultPkg = name }
+}
+
+func newConfig(opts []ConvertOption) *config {
+	c := &config{commentChar: '#', maxDepth: 64, style: "default", tabWidth: 4}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
+
+// Convert reads preto source from r and writes the proto to w
+func Convert(r io.Reader, w io.Writer, opts ...ConvertOption) error {
+	return ConvertContext(context.Background(), r, w, opts...)
+}
+
+// ConvertContext is like Convert but stops early with ctx.Err() if ctx
+// is cancelled
+func ConvertContext(ctx context.Context, r io.Reader, w io.Writer, opts ...ConvertOption) error {
+	c := newConfig(opts)
+	st, ok := styles[c.style]
+	if !ok {
+		return fmt.Errorf("unknown style %q", c.style)
+	}
+	f, err := ParseContext(ctx, r, opts...)
+	if err != nil {
+		return err
+	}
+	if c.sortFields {
+		sortFields(f)
+	}
+	e := emitter{w: w, stripComments: c.stripComments, style: st, packRepeated: c.packRepeated, header: c.header,
+		eol: c.eol}
+	return e.emit(f)
+}
+
+// Parse reads preto source from r and returns the validated File
+func Parse(r io.Reader, opts ...ConvertOption) (*File, error) {
+	return ParseContext(context.Background(), r, opts...)
+}
+
+// ParseContext is like Parse but stops early with ctx.Err() if ctx is
+// cancelled
+func ParseContext(ctx context.Context, r io.Reader, opts ...ConvertOption) (*File, error) {
+	c := newConfig(opts)
+	if err := checkCommentChar(c.commentChar); err != nil {
+		return nil, err
+	}
+	if c.tabWidth < 1 {
+		return nil, fmt.Errorf("tab width must be at least 1, got %d", c.tabWidth)
+	}
+	if c.defaultPkg != "" {
+		for _, part := range strings.Split(c.defaultPkg, ".") {
+			if !identRegexp.MatchString(part) {
+				return nil, fmt.Errorf("invalid default package %q", c.defaultPkg)
+			}
+		}
+	}
+	// cancelling stops the lexer goroutine however parsing ends
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	l := newLexer(r)
+	l.c = make(chan Item)
+	l.done = ctx.Done()
+	l.comment = c.commentChar
+	l.strict = c.strict
+	go l.lex()
+
+	p := parser{c: l.c, ctx: ctx, typeMapper: c.typeMapper, maxDepth: c.maxDepth, trace: c.trace,
+		warnFieldCost: c.warnFieldCost, exactComments: c.exactComments, warnEmpty: c.warnEmpty,
+		tabWidth: c.tabWidth, noOptional: c.noOptional, requirePkg: c.requirePkg, defaultPkg: c.defaultPkg}
+	if err := p.run(); err != nil {
+		return nil, err
+	}
+	collectDirectives(p.file)
+	addWellKnownImports(p.file)
+	if errs := validate(p.file); len(errs) > 0 {
+		return nil, &invalidError{errs}
+	}
+	p.file.warnings = append(p.file.warnings, keywordWarnings(p.file)...)
+	return p.file, nil
+}
+
+// invalidError holds the problems found in a file which parsed but
+// which protoc would reject
+type invalidError struct {
+	errs []error
+}
+
+func (e *invalidError) Error() string {
+	return errors.Join(e.errs...).Error()
+}
+
+func (e *invalidError) Unwrap() []error {
+	return e.errs
+}
+
+// run parses the file, converting a panic into an error
+func (p *parser) run() (err error) {
+	defer func() {
+		r := recover()
+		switch r := r.(type) {
+		case nil:
+		case runtime.Error:
+			panic(r)
+		case error:
+			err = r
+		default:
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	p.parse()
+	return nil
+}
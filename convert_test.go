@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestConvertNoGoroutineLeak checks that the lexer goroutine exits after
+// both successful and failed conversions
+func TestConvertNoGoroutineLeak(t *testing.T) {
+	good := "package test\n\nmsg Foo\n  a str 1\n  b []i32 2\n"
+	bad := "package test\n\nmsg Foo\n  a str\n  b []i32 2\n"
+	before := runtime.NumGoroutine()
+	for i := 0; i < 1000; i++ {
+		src := good
+		if i%2 == 1 {
+			src = bad
+		}
+		err := Convert(strings.NewReader(src), &bytes.Buffer{})
+		if (err != nil) != (src == bad) {
+			t.Fatalf("conversion %d: unexpected error %v", i, err)
+		}
+	}
+	// give exiting goroutines a moment to finish
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("%d goroutines before converting, %d after", before, n)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestConvertWriteError(t *testing.T) {
+	err := Convert(strings.NewReader("package test\n\nmsg Foo\n  a str 1\n"), failingWriter{})
+	if err == nil || err.Error() != "disk full" {
+		t.Errorf("expected the write error, got %v", err)
+	}
+}
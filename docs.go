@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+)
+
+// extractDocs returns the comments in the file keyed by the dotted path
+// of the declaration they document. Comment lines directly before a
+// declaration and its trailing comment are both included.
+func extractDocs(f *File) map[string]string {
+	docs := map[string]string{}
+	collectDocs(docs, "", f.Body)
+	return docs
+}
+
+func collectDocs(docs map[string]string, prefix string, b body) {
+	leading := []string{}
+	add := func(name, trailing string) {
+		lines := leading
+		if trailing != "" && !isDirective(trailing) {
+			lines = append(lines, trailing)
+		}
+		if len(lines) > 0 {
+			docs[prefix+name] = strings.Join(lines, "\n")
+		}
+		leading = []string{}
+	}
+	for _, n := range b {
+		switch n := n.(type) {
+		case *Comment:
+			if !isDirective(n.Text) {
+				leading = append(leading, n.Text)
+			}
+		case *Message:
+			add(n.Name, n.Comment)
+			collectDocs(docs, prefix+n.Name+".", n.Body)
+		case *Enum:
+			add(n.Name, n.Comment)
+			collectDocs(docs, prefix+n.Name+".", n.Body)
+		case *Service:
+			add(n.Name, n.Comment)
+			collectDocs(docs, prefix+n.Name+".", n.Body)
+		case *Oneof:
+			// oneof fields are scoped to the enclosing message
+			add(n.Name, n.Comment)
+			collectDocs(docs, prefix, n.Body)
+		case *Field:
+			add(n.Name, n.Comment)
+		case *EnumValue:
+			add(n.Name, n.Comment)
+		case *RPC:
+			add(n.Name, n.Comment)
+		default:
+			leading = []string{}
+		}
+	}
+}
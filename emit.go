@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const indentSpace = "    "
+
+// emitter walks a File and writes it out as proto
+type emitter struct {
+	w io.Writer
+
+	stripComments bool
+
+	// syntax, if set, replaces the file's syntax and adjusts labels to
+	// suit it
+	syntax  string
+	inOneof bool
+
+	// style defaults to the default style
+	style *style
+
+	// packRepeated adds packed = true to repeated scalar fields in
+	// proto2, where they aren't packed by default
+	packRepeated bool
+	// fileSyntax is the syntax being written, set by emit
+	fileSyntax string
+
+	// header is written as a comment at the top of the file
+	header string
+
+	// eol ends each line, "\n" if empty
+	eol string
+
+	// err is the first error writing to w, after which nothing more is
+	// written
+	err error
+}
+
+func (e *emitter) write(lvl int, s string) {
+	if e.style == nil {
+		e.style = styles["default"]
+	}
+	if e.err != nil {
+		return
+	}
+	l := strings.Repeat(e.style.indent, lvl)
+	if e.eol != "" && e.eol != "\n" {
+		s = strings.ReplaceAll(s, "\n", e.eol)
+	}
+	_, e.err = e.w.Write([]byte(l + s))
+}
+
+func (e *emitter) writef(lvl int, f string, args ...interface{}) {
+	e.write(lvl, fmt.Sprintf(f, args...))
+}
+
+// emit writes f, returning the first error writing it
+func (e *emitter) emit(f *File) error {
+	if e.header != "" {
+		for _, line := range strings.Split(e.header, "\n") {
+			e.writef(0, "// %s\n", line)
+		}
+		e.write(0, "\n")
+	}
+	e.fileSyntax = e.syntax
+	for _, n := range f.Body {
+		switch n := n.(type) {
+		case *Syntax:
+			if e.fileSyntax == "" {
+				e.fileSyntax = n.Value
+			}
+		case *Edition:
+			e.fileSyntax = "editions"
+		}
+	}
+	if e.syntax != "" {
+		hasSyntax := false
+		for _, n := range f.Body {
+			_, ok := n.(*Syntax)
+			hasSyntax = hasSyntax || ok
+		}
+		if !hasSyntax {
+			e.statement(0, "", "syntax = %q", e.syntax)
+		}
+	}
+	b := f.Body
+	if e.style != nil && e.style.separateBlocks {
+		b = separateBlocks(b)
+	}
+	e.body(0, b)
+	return e.err
+}
+
+func (e *emitter) body(lvl int, b body) {
+	for _, n := range b {
+		e.node(lvl, n)
+	}
+}
+
+func (e *emitter) node(lvl int, n node) {
+	switch n := n.(type) {
+	case *Blank:
+		e.write(0, "\n")
+	case *Syntax:
+		if e.syntax != "" {
+			e.statement(lvl, "", "syntax = %q", e.syntax)
+		} else {
+			e.statement(lvl, "", "syntax = %q", n.Value)
+		}
+	case *Edition:
+		e.statement(lvl, "", "edition = %q", n.Value)
+	case *Package:
+		e.statement(lvl, "", "package %s", n.Name)
+	case *Import:
+		if n.Modifier != "" {
+			e.statement(lvl, n.Comment, "import %s %q", n.Modifier, n.Path)
+		} else {
+			e.statement(lvl, n.Comment, "import %q", n.Path)
+		}
+	case *Option:
+		e.statement(lvl, n.Comment, "option %s = %s", n.Name, n.Value)
+	case *Comment:
+		if !e.stripComments && !isDirective(n.Text) {
+			e.writef(lvl, "// %s\n", n.Text)
+		}
+	case *Raw:
+		for _, line := range strings.Split(n.Text, "\n") {
+			if line == "" {
+				e.write(0, "\n")
+				continue
+			}
+			e.writef(lvl, "%s\n", line)
+		}
+	case *Message:
+		e.block(lvl, "message", n.Name, n.Comment, n.Body, n.EndComment)
+	case *Enum:
+		e.block(lvl, "enum", n.Name, n.Comment, n.Body, n.EndComment)
+	case *Oneof:
+		e.inOneof = true
+		e.block(lvl, "oneof", n.Name, n.Comment, n.Body, n.EndComment)
+		e.inOneof = false
+	case *Service:
+		e.block(lvl, "service", n.Name, n.Comment, n.Body, n.EndComment)
+	case *Field:
+		decl := fmt.Sprintf("%s %s = %d", n.Type, n.Name, n.Number)
+		if label := e.label(n); label != "" {
+			decl = label + " " + decl
+		}
+		if options := e.fieldOptions(n); len(options) > 0 {
+			opts := []string{}
+			for _, o := range options {
+				opts = append(opts, o.Name+" = "+o.Value)
+			}
+			decl += fmt.Sprintf(" [%s]", strings.Join(opts, ", "))
+		}
+		e.statement(lvl, n.Comment, "%s", decl)
+	case *Reserved:
+		items := []string{}
+		for _, r := range n.Ranges {
+			items = append(items, r.String())
+		}
+		for _, name := range n.Names {
+			items = append(items, strconv.Quote(name))
+		}
+		e.statement(lvl, n.Comment, "reserved %s", strings.Join(items, ", "))
+	case *Extensions:
+		items := []string{}
+		for _, r := range n.Ranges {
+			items = append(items, r.String())
+		}
+		e.statement(lvl, n.Comment, "extensions %s", strings.Join(items, ", "))
+	case *EnumValue:
+		e.statement(lvl, n.Comment, "%s = %d", n.Name, n.Number)
+	case *RPC:
+		e.statement(lvl, n.Comment, "rpc %s(%s%s) returns (%s%s)", n.Name,
+			stream(n.RequestStream), n.Request,
+			stream(n.ResponseStream), n.Response,
+		)
+	default:
+		panic(fmt.Sprintf("emitter: unknown node %T", n))
+	}
+}
+
+// packableTypes are the scalar types which can be packed
+var packableTypes = map[string]bool{
+	"int32": true, "int64": true, "uint32": true, "uint64": true,
+	"sint32": true, "sint64": true, "fixed32": true, "fixed64": true,
+	"sfixed32": true, "sfixed64": true, "float": true, "double": true,
+	"bool": true,
+}
+
+// fieldOptions returns the options to write for f. Repeated scalars are
+// packed by default in proto3, so packed = true is only added in proto2.
+func (e *emitter) fieldOptions(f *Field) []*FieldOption {
+	if !e.packRepeated || e.fileSyntax == "proto3" || e.label(f) != "repeated" || !packableTypes[f.Type] {
+		return f.Options
+	}
+	for _, o := range f.Options {
+		if o.Name == "packed" {
+			return f.Options
+		}
+	}
+	return append(f.Options[:len(f.Options):len(f.Options)], &FieldOption{Name: "packed", Value: "true"})
+}
+
+// label returns the label to write for f
+func (e *emitter) label(f *Field) string {
+	switch {
+	case e.syntax == "proto3" && f.inferred && f.Label == "optional":
+		return ""
+	case e.syntax == "proto2" && f.Label == "" && !e.inOneof && !strings.HasPrefix(f.Type, "map<"):
+		return "optional"
+	}
+	return f.Label
+}
+
+// block writes a braced declaration and its contents
+func (e *emitter) block(lvl int, keyword, name, comment string, b body, endComment string) {
+	e.writef(lvl, "%s %s {", keyword, name)
+	e.trailingComment(comment)
+	e.body(lvl+1, b)
+	e.write(lvl, "}")
+	// the first line of a long comment follows the brace, the rest go
+	// on lines of their own
+	lines := strings.Split(endComment, "\n")
+	e.trailingComment(lines[0])
+	for _, line := range lines[1:] {
+		if !e.stripComments {
+			e.writef(lvl, "// %s\n", line)
+		}
+	}
+}
+
+// statement writes a statement ending in a semicolon, followed by its
+// trailing comment if it has one. Every statement goes through here so
+// each gets exactly one semicolon.
+func (e *emitter) statement(lvl int, comment, format string, args ...interface{}) {
+	s := strings.TrimRight(fmt.Sprintf(format, args...), "; ")
+	e.writef(lvl, "%s;", s)
+	e.trailingComment(comment)
+}
+
+// trailingComment writes a comment, if any, and ends the line
+func (e *emitter) trailingComment(s string) {
+	if s != "" && !e.stripComments && !isDirective(s) {
+		e.writef(0, " // %s", s)
+	}
+	e.write(0, "\n")
+}
+
+func stream(b bool) string {
+	if b {
+		return "stream "
+	}
+	return ""
+}
+
+func (r *Range) String() string {
+	switch {
+	case r.Max:
+		return fmt.Sprintf("%d to max", r.Start)
+	case r.Start == r.End:
+		return strconv.Itoa(r.Start)
+	default:
+		return fmt.Sprintf("%d to %d", r.Start, r.End)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// unquoteProto decodes a single or double quoted protobuf string literal
+// into its raw bytes
+func unquoteProto(s string) ([]byte, error) {
+	if len(s) < 2 || (s[0] != '"' && s[0] != '\'') || s[len(s)-1] != s[0] {
+		return nil, fmt.Errorf("%s is not a quoted string", s)
+	}
+	s = s[1 : len(s)-1]
+	out := []byte{}
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if ch != '\\' {
+			out = append(out, ch)
+			continue
+		}
+		i++
+		if i == len(s) {
+			return nil, fmt.Errorf("string ends with a backslash")
+		}
+		switch ch = s[i]; ch {
+		case 'a':
+			out = append(out, '\a')
+		case 'b':
+			out = append(out, '\b')
+		case 'f':
+			out = append(out, '\f')
+		case 'n':
+			out = append(out, '\n')
+		case 'r':
+			out = append(out, '\r')
+		case 't':
+			out = append(out, '\t')
+		case 'v':
+			out = append(out, '\v')
+		case '\\', '\'', '"', '?':
+			out = append(out, ch)
+		case 'x', 'X':
+			j := i + 1
+			for j < len(s) && j < i+3 && strings.IndexByte("0123456789abcdefABCDEF", s[j]) >= 0 {
+				j++
+			}
+			n, err := strconv.ParseUint(s[i+1:j], 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid hex escape in %q", s)
+			}
+			out = append(out, byte(n))
+			i = j - 1
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			j := i
+			for j < len(s) && j < i+3 && s[j] >= '0' && s[j] <= '7' {
+				j++
+			}
+			n, err := strconv.ParseUint(s[i:j], 8, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid octal escape in %q", s)
+			}
+			out = append(out, byte(n))
+			i = j - 1
+		default:
+			return nil, fmt.Errorf("invalid escape \\%c in %q", ch, s)
+		}
+	}
+	return out, nil
+}
+
+// quoteBytes quotes b as a protobuf string literal, escaping anything
+// which isn't printable ascii as octal
+func quoteBytes(b []byte) string {
+	sb := strings.Builder{}
+	sb.WriteByte('"')
+	for _, ch := range b {
+		switch {
+		case ch == '\n':
+			sb.WriteString(`\n`)
+		case ch == '\r':
+			sb.WriteString(`\r`)
+		case ch == '\t':
+			sb.WriteString(`\t`)
+		case ch == '"' || ch == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(ch)
+		case ch < 0x20 || ch >= 0x7f:
+			fmt.Fprintf(&sb, `\%03o`, ch)
+		default:
+			sb.WriteByte(ch)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestExamples converts each examples/*.preto with a .generated.proto
+// next to it and compares the result with that file
+func TestExamples(t *testing.T) {
+	files, err := filepath.Glob("examples/*.preto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fn := range files {
+		golden := strings.TrimSuffix(fn, ".preto") + ".generated.proto"
+		want, err := os.ReadFile(golden)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		t.Run(filepath.Base(fn), func(t *testing.T) {
+			src, err := os.Open(fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer src.Close()
+			got := &bytes.Buffer{}
+			if err := Convert(src, got, WithHeader(defaultHeader)); err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != string(want) {
+				t.Errorf("output differs from %s:\n%s", golden, got)
+			}
+		})
+	}
+}
+
+// TestPackedExamples checks the output of
+// `preto convert -pack-repeated -emit proto2,proto3 examples/packed.preto`
+func TestPackedExamples(t *testing.T) {
+	src, err := os.Open("examples/packed.preto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	file, err := Parse(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newEmitter := func(w io.Writer) *emitter {
+		return &emitter{w: w, style: styles["default"], packRepeated: true, header: defaultHeader}
+	}
+	for _, syntax := range []string{"proto2", "proto3"} {
+		golden := "examples/packed_" + syntax + ".proto"
+		want, err := os.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []byte
+		write := func(fn string, data []byte) error {
+			got = data
+			return nil
+		}
+		if err := emitSyntax(file, "examples/packed.preto", syntax, newEmitter, write); err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(want) {
+			t.Errorf("output differs from %s:\n%s", golden, got)
+		}
+	}
+}
+
+// TestCompatExample checks the output of
+// `preto compat examples/compat_old.proto examples/compat_new.preto`
+func TestCompatExample(t *testing.T) {
+	old, err := os.ReadFile("examples/compat_old.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev, err := parseProto(string(old))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := os.Open("examples/compat_new.preto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	next, err := Parse(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile("examples/compat.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := &bytes.Buffer{}
+	for _, p := range compat(prev, next) {
+		got.WriteString("examples/compat_new.preto: " + p + "\n")
+	}
+	if got.String() != string(want) {
+		t.Errorf("output differs from examples/compat.txt:\n%s", got)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// formatIndent is one level of indentation in formatted preto
+const formatIndent = "  "
+
+// shorthands maps proto types back to their preto shorthand
+var shorthands = map[string]string{
+	"string":                 "str",
+	"int32":                  "i32",
+	"int64":                  "i64",
+	"uint32":                 "u32",
+	"uint64":                 "u64",
+	"sint32":                 "s32",
+	"sint64":                 "s64",
+	"fixed32":                "fx32",
+	"fixed64":                "fx64",
+	"sfixed32":               "sfx32",
+	"sfixed64":               "sfx64",
+	"google.protobuf.Any":    "any",
+	"google.protobuf.Struct": "struct",
+	"google.protobuf.Value":  "value",
+	"google.protobuf.Empty":  "empty",
+}
+
+// shorthand returns the preto shorthand for a proto type, if it has one
+func shorthand(t string) string {
+	if s, ok := shorthands[t]; ok {
+		return s
+	}
+	return t
+}
+
+// formatter walks a File and writes it back out as preto
+type formatter struct {
+	w       io.Writer
+	comment rune
+}
+
+func (f *formatter) writef(lvl int, format string, args ...interface{}) {
+	l := strings.Repeat(formatIndent, lvl)
+	fmt.Fprintf(f.w, l+format, args...)
+}
+
+func (f *formatter) format(file *File) {
+	for _, n := range file.Body {
+		if c, ok := n.(*Comment); ok && strings.HasPrefix(c.Text, `include "`) {
+			// keep include directives working
+			f.writef(0, "%cinclude %s\n", f.comment, strings.TrimPrefix(c.Text, "include "))
+			continue
+		}
+		f.node(0, n)
+	}
+}
+
+func (f *formatter) body(lvl int, b body, endComment string) {
+	for _, n := range b {
+		f.node(lvl, n)
+	}
+	if endComment != "" {
+		for _, line := range strings.Split(endComment, "\n") {
+			f.writef(lvl, "%c %s\n", f.comment, line)
+		}
+	}
+}
+
+func (f *formatter) node(lvl int, n node) {
+	switch n := n.(type) {
+	case *Blank:
+		f.writef(0, "\n")
+	case *Syntax:
+		f.writef(lvl, "syntax %s\n", n.Value)
+	case *Edition:
+		f.writef(lvl, "edition %s\n", n.Value)
+	case *Package:
+		f.writef(lvl, "package %s\n", n.Name)
+	case *Import:
+		switch {
+		case n.auto:
+		case n.Modifier != "":
+			f.writef(lvl, "import %s %q", n.Modifier, n.Path)
+			f.lineEnd(n.Comment)
+		default:
+			f.writef(lvl, "import %q", n.Path)
+			f.lineEnd(n.Comment)
+		}
+	case *Option:
+		if !n.auto {
+			f.writef(lvl, "option %s %s", n.Name, n.Value)
+			f.lineEnd(n.Comment)
+		}
+	case *Comment:
+		f.writef(lvl, "%c %s\n", f.comment, n.Text)
+	case *Raw:
+		f.writef(lvl, "%craw\n", f.comment)
+		for _, line := range strings.Split(n.Text, "\n") {
+			if line == "" {
+				f.writef(0, "\n")
+				continue
+			}
+			f.writef(lvl, "%s\n", line)
+		}
+		f.writef(lvl, "%cendraw\n", f.comment)
+	case *Message:
+		f.block(lvl, "msg", n.Name, n.Comment)
+		f.body(lvl+1, n.Body, n.EndComment)
+	case *Enum:
+		f.block(lvl, "enum", n.Name, n.Comment)
+		f.body(lvl+1, n.Body, n.EndComment)
+	case *Oneof:
+		f.block(lvl, "oneof", n.Name, n.Comment)
+		f.body(lvl+1, n.Body, n.EndComment)
+	case *Service:
+		f.block(lvl, "service", n.Name, n.Comment)
+		f.body(lvl+1, n.Body, n.EndComment)
+	case *Field:
+		t := shorthand(n.Type)
+		label := n.Label
+		if strings.HasPrefix(t, "map<") {
+			i := strings.Index(t, ",")
+			t = fmt.Sprintf("map[%s]%s", shorthand(t[4:i]), shorthand(strings.TrimSpace(t[i+1:len(t)-1])))
+		}
+		if n.inferred {
+			if label == "repeated" {
+				t = "[]" + t
+			}
+			label = ""
+		}
+		f.writef(lvl, "%s %s %d", n.Name, t, n.Number)
+		if label != "" {
+			f.writef(0, " %s", label)
+		}
+		if len(n.Options) > 0 {
+			opts := []string{}
+			for _, o := range n.Options {
+				opts = append(opts, o.Name+" = "+o.Value)
+			}
+			f.writef(0, " [%s]", strings.Join(opts, ", "))
+		}
+		f.lineEnd(n.Comment)
+	case *Reserved:
+		items := []string{}
+		for _, r := range n.Ranges {
+			items = append(items, r.String())
+		}
+		for _, name := range n.Names {
+			items = append(items, strconv.Quote(name))
+		}
+		f.writef(lvl, "reserved %s", strings.Join(items, ", "))
+		f.lineEnd(n.Comment)
+	case *Extensions:
+		items := []string{}
+		for _, r := range n.Ranges {
+			items = append(items, r.String())
+		}
+		f.writef(lvl, "extensions %s", strings.Join(items, ", "))
+		f.lineEnd(n.Comment)
+	case *EnumValue:
+		f.writef(lvl, "%s %d", n.Name, n.Number)
+		f.lineEnd(n.Comment)
+	case *RPC:
+		f.writef(lvl, "rpc %s %s%s %s%s", n.Name,
+			stream(n.RequestStream), shorthand(n.Request),
+			stream(n.ResponseStream), shorthand(n.Response),
+		)
+		f.lineEnd(n.Comment)
+	default:
+		panic(fmt.Sprintf("formatter: unknown node %T", n))
+	}
+}
+
+// block writes the declaration line of a block
+func (f *formatter) block(lvl int, keyword, name, comment string) {
+	f.writef(lvl, "%s %s", keyword, name)
+	f.lineEnd(comment)
+}
+
+// lineEnd writes a trailing comment, if any, and ends the line
+func (f *formatter) lineEnd(comment string) {
+	if comment != "" {
+		f.writef(0, " %c %s", f.comment, comment)
+	}
+	f.writef(0, "\n")
+}
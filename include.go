@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// expandIncludes reads fn, replacing each unindented `#include "path"`
+// line with the contents of that file. Paths are relative to the file
+// containing the include. The package and syntax statements of included
+// files are dropped since they are merged into a single file. The
+// returned lineMap records where each line of the result came from.
+func expandIncludes(fn string, comment rune) ([]byte, lineMap, error) {
+	lines := lineMap{root: fn}
+	src, err := expandIncludesFrom(fn, comment, nil, &lines)
+	return src, lines, err
+}
+
+func expandIncludesFrom(fn string, comment rune, stack []string, lines *lineMap) ([]byte, error) {
+	abs, err := filepath.Abs(fn)
+	if err != nil {
+		return nil, err
+	}
+	for i, s := range stack {
+		if s == abs {
+			cycle := append(stack[i:], abs)
+			return nil, fmt.Errorf("include cycle: %s", strings.Join(cycle, " -> "))
+		}
+	}
+	stack = append(stack, abs)
+
+	src, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	directive := string(comment) + "include "
+	out := &bytes.Buffer{}
+	s := bufio.NewScanner(bytes.NewReader(src))
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		switch {
+		case strings.HasPrefix(line, directive):
+			path, err := strconv.Unquote(strings.TrimSpace(line[len(directive):]))
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid include %q", fn, line)
+			}
+			b, err := expandIncludesFrom(filepath.Join(filepath.Dir(fn), path), comment, stack, lines)
+			if err != nil {
+				return nil, err
+			}
+			out.Write(b)
+		case len(stack) > 1 && (strings.HasPrefix(line, "package ") || strings.HasPrefix(line, "syntax ")):
+		default:
+			out.WriteString(line + "\n")
+			lines.sources = append(lines.sources, sourceLine{fn, n})
+		}
+	}
+	return out.Bytes(), s.Err()
+}
+
+// sourceLine is the file and line a line of expanded source came from
+type sourceLine struct {
+	file string
+	line int
+}
+
+// lineMap maps the lines of source with its includes expanded back to
+// the files they came from
+type lineMap struct {
+	// root is the file which was expanded
+	root string
+	// sources holds where each line came from, the first line first
+	sources []sourceLine
+}
+
+// lineRegexp matches a line number in an error or warning
+var lineRegexp = regexp.MustCompile(`\bline ([0-9]+)`)
+
+// translate rewrites the line numbers in msg from the expanded source
+// to the lines they came from. Lines from included files also name the
+// file.
+func (m lineMap) translate(msg string) string {
+	return lineRegexp.ReplaceAllStringFunc(msg, func(s string) string {
+		n, _ := strconv.Atoi(s[len("line "):])
+		file, line := m.position(n)
+		if file == m.root {
+			return fmt.Sprintf("line %d", line)
+		}
+		return fmt.Sprintf("%s line %d", file, line)
+	})
+}
+
+// position returns the file and line which line n of the expanded
+// source came from. Lines outside the map are returned unchanged.
+func (m lineMap) position(n int) (string, int) {
+	if n < 1 || n > len(m.sources) {
+		return m.root, n
+	}
+	return m.sources[n-1].file, m.sources[n-1].line
+}
+
+// translateErr is like translate for each of the errors in err, keeping
+// invalidError so that the exit status is unchanged
+func (m lineMap) translateErr(err error) error {
+	var invalid *invalidError
+	if errors.As(err, &invalid) {
+		errs := []error{}
+		for _, err := range invalid.errs {
+			errs = append(errs, m.translateErr(err))
+		}
+		return &invalidError{errs}
+	}
+	return errors.New(m.translate(err.Error()))
+}
+
+// sourceModTime returns the latest modification time of fn and the
+// files it includes, which is when its output last needed regenerating
+func sourceModTime(fn string, comment rune) (time.Time, error) {
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return time.Time{}, err
+	}
+	latest := fi.ModTime()
+	src, err := os.ReadFile(fn)
+	if err != nil {
+		return time.Time{}, err
+	}
+	directive := string(comment) + "include "
+	for _, line := range strings.Split(string(src), "\n") {
+		if !strings.HasPrefix(line, directive) {
+			continue
+		}
+		path, err := strconv.Unquote(strings.TrimSpace(line[len(directive):]))
+		if err != nil {
+			return time.Time{}, fmt.Errorf("%s: invalid include %q", fn, line)
+		}
+		t, err := sourceModTime(filepath.Join(filepath.Dir(fn), path), comment)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if t.After(latest) {
+			latest = t
+		}
+	}
+	return latest, nil
+}
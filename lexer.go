@@ -0,0 +1,946 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ItemType is the type of a token produced by the lexer
+type ItemType int
+
+const (
+	ItemUnknown ItemType = iota
+	ItemError
+	ItemPackage
+	ItemMessageType
+	ItemIdentifier
+	ItemCommentStart
+	ItemLeftMeta
+	ItemRightMeta
+	ItemEqual
+	ItemNumber
+	ItemText
+	ItemFieldType
+	ItemFieldName
+	ItemFieldNum
+	ItemFieldOption
+	ItemNewline
+	ItemWhitespace
+	ItemOption
+	ItemOptionName
+	ItemEnum
+	ItemOneof
+	ItemFieldLabel
+	ItemSyntax
+	ItemImport
+	ItemService
+	ItemRPC
+	ItemStream
+	ItemReserved
+	ItemExtensions
+	ItemBlockOpen
+	ItemBlockEnd
+	ItemDeleted
+	ItemRaw
+	ItemImportModifier
+	ItemEdition
+)
+
+func (i ItemType) String() string {
+	switch i {
+	case ItemUnknown:
+		return "UNKNOWN"
+	case ItemError:
+		return "ERROR"
+	case ItemPackage:
+		return "PACKAGE"
+	case ItemMessageType:
+		return "MESSAGETYPE"
+	case ItemIdentifier:
+		return "IDENT"
+	case ItemCommentStart:
+		return "COMMENT"
+	case ItemLeftMeta:
+		return "LEFTMETA"
+	case ItemRightMeta:
+		return "RIGHTMETA"
+	case ItemEqual:
+		return "EQUAL"
+	case ItemNumber:
+		return "NUMBER"
+	case ItemText:
+		return "TEXT"
+	case ItemFieldType:
+		return "FIELDTYPE"
+	case ItemFieldName:
+		return "FIELDNAME"
+	case ItemFieldOption:
+		return "FIELDOPTION"
+	case ItemFieldNum:
+		return "FIELDNUM"
+	case ItemNewline:
+		return "NL"
+	case ItemWhitespace:
+		return "WS"
+	case ItemOption:
+		return "OPTIONTYPE"
+	case ItemOptionName:
+		return "OPTIONVAL"
+	case ItemEnum:
+		return "ENUM"
+	case ItemOneof:
+		return "ONEOF"
+	case ItemFieldLabel:
+		return "FIELDLABEL"
+	case ItemSyntax:
+		return "SYNTAX"
+	case ItemImport:
+		return "IMPORT"
+	case ItemService:
+		return "SERVICE"
+	case ItemRPC:
+		return "RPC"
+	case ItemStream:
+		return "STREAM"
+	case ItemReserved:
+		return "RESERVED"
+	case ItemExtensions:
+		return "EXTENSIONS"
+	case ItemBlockOpen:
+		return "BLOCKOPEN"
+	case ItemBlockEnd:
+		return "END"
+	case ItemDeleted:
+		return "DELETED"
+	case ItemRaw:
+		return "RAW"
+	case ItemImportModifier:
+		return "IMPORTMODIFIER"
+	case ItemEdition:
+		return "EDITION"
+	default:
+		return "ITEM(" + strconv.Itoa(int(i)) + ")"
+	}
+}
+
+// Category is a coarse classification of items for syntax highlighting
+type Category string
+
+// Categories of items
+const (
+	CategoryNone        Category = ""
+	CategoryKeyword     Category = "keyword"
+	CategoryType        Category = "type"
+	CategoryIdentifier  Category = "identifier"
+	CategoryLiteral     Category = "literal"
+	CategoryComment     Category = "comment"
+	CategoryPunctuation Category = "punctuation"
+	CategoryWhitespace  Category = "whitespace"
+)
+
+// Category returns the highlighting category of the item type. Items
+// for declarations carry the declared name, so they are identifiers.
+func (i ItemType) Category() Category {
+	switch i {
+	case ItemFieldLabel, ItemStream, ItemBlockEnd, ItemImportModifier:
+		return CategoryKeyword
+	case ItemFieldType:
+		return CategoryType
+	case ItemPackage, ItemMessageType, ItemIdentifier, ItemFieldName,
+		ItemOption, ItemEnum, ItemOneof, ItemService, ItemRPC:
+		return CategoryIdentifier
+	case ItemNumber, ItemText, ItemFieldNum, ItemFieldOption,
+		ItemOptionName, ItemSyntax, ItemEdition, ItemImport, ItemReserved, ItemExtensions:
+		return CategoryLiteral
+	case ItemCommentStart, ItemRaw:
+		return CategoryComment
+	case ItemLeftMeta, ItemRightMeta, ItemEqual, ItemBlockOpen, ItemDeleted:
+		return CategoryPunctuation
+	case ItemNewline, ItemWhitespace:
+		return CategoryWhitespace
+	default:
+		return CategoryNone
+	}
+}
+
+type lexer struct {
+	buf *bufio.Reader
+	c   chan Item
+	// done is closed when the consumer of c stops reading
+	done <-chan struct{}
+
+	// queue holds emitted items when there is no channel
+	queue []Item
+
+	// comment is the rune which starts a comment
+	comment rune
+	// strict rejects unindented lines which don't start with a keyword
+	strict bool
+	line   int
+	// offset is the number of bytes read from buf
+	offset int
+
+	// inline is set inside a message body written on one line, e.g.
+	// `msg Point { x i32 1; y i32 2 }`
+	inline bool
+
+	// pending holds runes which have been read ahead, last is the rune
+	// most recently returned by read
+	pending []rune
+	last    rune
+}
+
+func newLexer(r io.Reader) *lexer {
+	return &lexer{buf: bufio.NewReader(r), comment: '#', line: 1, last: -1}
+}
+
+// checkCommentChar returns an error if ch can't be used to start comments
+// because the lexer already gives it a meaning
+func checkCommentChar(ch rune) error {
+	switch {
+	case isLetter(ch), isNumber(ch), isWhitespace(ch), unicode.IsSpace(ch):
+	case strings.ContainsRune(`"'[](){}<>=,.:;-\`, ch):
+	default:
+		return nil
+	}
+	return fmt.Errorf("%q cannot be used as a comment character", ch)
+}
+
+// Item is a token produced by the lexer
+type Item struct {
+	Type  ItemType
+	Value string
+	Line  int // the line the item is on, starting at 1
+}
+
+func (l *lexer) emit(t ItemType, s string) {
+	i := Item{Type: t, Value: s, Line: l.line}
+	if t == ItemNewline && s != ";" {
+		l.line++
+	}
+	if l.c == nil {
+		l.queue = append(l.queue, i)
+		return
+	}
+	select {
+	case l.c <- i:
+	case <-l.done:
+		panic(errLexerStopped)
+	}
+}
+
+// errLexerStopped unwinds the lexer when nothing is reading its items
+var errLexerStopped = errors.New("lexer stopped")
+
+// read returns the next rune, joining lines which end in a backslash
+func (l *lexer) read() rune {
+	ch := l.readRaw()
+	for ch == '\\' {
+		next := l.readRaw()
+		if next != '\n' {
+			l.pending = append(l.pending, next)
+			break
+		}
+		l.line++
+		ch = l.readRaw()
+	}
+	l.last = ch
+	return ch
+}
+
+// readRaw returns the next rune without handling line continuations
+func (l *lexer) readRaw() rune {
+	if n := len(l.pending); n > 0 {
+		ch := l.pending[n-1]
+		l.pending = l.pending[:n-1]
+		return ch
+	}
+	ch, size, err := l.buf.ReadRune()
+	if err == io.EOF {
+		return rune(0)
+	}
+	if err != nil {
+		panic(err)
+	}
+	if ch == utf8.RuneError && size == 1 {
+		panic(fmt.Sprintf("invalid UTF-8 at byte offset %d", l.offset))
+	}
+	l.offset += size
+	if ch == byteOrderMark && l.offset == size {
+		// some editors start UTF-8 files with a BOM, skip it
+		return l.readRaw()
+	}
+	return ch
+}
+
+// peekLine returns the rest of the current line without consuming it
+func (l *lexer) peekLine() string {
+	b := []rune{}
+	ch := l.readRaw()
+	for ; ch != '\n' && ch != rune(0); ch = l.readRaw() {
+		b = append(b, ch)
+	}
+	if ch == '\n' {
+		l.pending = append(l.pending, ch)
+	}
+	for i := len(b) - 1; i >= 0; i-- {
+		l.pending = append(l.pending, b[i])
+	}
+	l.last = -1
+	return string(b)
+}
+
+// byteOrderMark may start the input, and is ignored
+const byteOrderMark = '\uFEFF'
+
+// unread pushes back the last rune returned by read
+func (l *lexer) unread() {
+	if l.last < 0 {
+		return
+	}
+	l.pending = append(l.pending, l.last)
+	l.last = -1
+}
+
+// lex runs the lexer, sending items to l.c until the input is exhausted
+// or l.done is closed. An error is sent as an ItemError.
+func (l *lexer) lex() {
+	defer close(l.c)
+	defer func() {
+		r := recover()
+		if r == nil || r == errLexerStopped {
+			return
+		}
+		select {
+		case l.c <- Item{Type: ItemError, Value: fmt.Sprint(r), Line: l.line}:
+		case <-l.done:
+		}
+	}()
+	state := scanText
+	for state != nil {
+		state = state(l)
+	}
+}
+
+// Lexer tokenizes preto source one item at a time, e.g. for syntax
+// highlighting, without running the parser.
+type Lexer struct {
+	l     *lexer
+	state scanFn
+}
+
+// NewLexer returns a Lexer reading from r
+func NewLexer(r io.Reader) *Lexer {
+	return &Lexer{l: newLexer(r), state: scanText}
+}
+
+// Next returns the next item, or io.EOF once the input is exhausted
+func (x *Lexer) Next() (Item, error) {
+	for len(x.l.queue) == 0 {
+		if x.state == nil {
+			return Item{}, io.EOF
+		}
+		if err := x.step(); err != nil {
+			x.state = nil
+			return Item{}, err
+		}
+	}
+	i := x.l.queue[0]
+	x.l.queue = x.l.queue[1:]
+	return i, nil
+}
+
+// step runs the current scan state, converting lexer panics to errors
+func (x *Lexer) step() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("lexer: %v", r)
+		}
+	}()
+	x.state = x.state(x.l)
+	return nil
+}
+
+type reader interface {
+	read() rune
+	unread()
+}
+
+func readFunc(l reader, ok func(rune) bool) string {
+	b := &bytes.Buffer{}
+	for {
+		ch := l.read()
+		if !ok(ch) {
+			l.unread()
+			break
+		}
+		_, err := b.WriteRune(ch)
+		if err != nil {
+			panic(err)
+		}
+	}
+	// consume whitespaces until we have no more
+	_ = readWhitespace(l)
+	return b.String()
+}
+
+// readNum reads a decimal, hex or octal number
+func readNum(l reader) string {
+	return readFunc(l, func(ch rune) bool {
+		return isNumber(ch) || strings.ContainsRune("xXabcdefABCDEF", ch)
+	})
+}
+
+// readSignedNum reads a decimal number with an optional sign, fraction
+// and exponent, e.g. -1, 3.14 or 1e-5
+func readSignedNum(l reader) string {
+	b := &bytes.Buffer{}
+	digits := func() int {
+		n := 0
+		for ch := l.read(); isNumber(ch); ch = l.read() {
+			b.WriteRune(ch)
+			n++
+		}
+		l.unread()
+		return n
+	}
+	optional := func(chars string) bool {
+		ch := l.read()
+		if ch != rune(0) && strings.ContainsRune(chars, ch) {
+			b.WriteRune(ch)
+			return true
+		}
+		l.unread()
+		return false
+	}
+	optional("-")
+	n := digits()
+	if optional(".") {
+		n += digits()
+	}
+	if n == 0 {
+		panic("invalid number " + strconv.Quote(b.String()))
+	}
+	if optional("eE") {
+		optional("-+")
+		if digits() == 0 {
+			panic("invalid exponent in number " + strconv.Quote(b.String()))
+		}
+	}
+	_ = readWhitespace(l)
+	return b.String()
+}
+
+func readAlphanum(l reader) string {
+	return readFunc(l, func(ch rune) bool {
+		return isLetter(ch) || isNumber(ch) || ch == '_' || ch == '.'
+	})
+}
+
+// readFieldType reads a field type. Whitespace is allowed inside
+// brackets and directly after a closing bracket, e.g. `map[ str ] int`.
+func readFieldType(l reader) string {
+	depth := 0
+	last := rune(0)
+	return readFunc(l, func(ch rune) bool {
+		ok := true
+		switch {
+		case ch == '[':
+			depth++
+		case ch == ']':
+			depth--
+		case ch == ' ' || ch == '\t':
+			ok = depth > 0 || last == ']'
+			if ok {
+				return true // don't track whitespace as last
+			}
+		default:
+			ok = isLetter(ch) || isNumber(ch) || ch == '_' || ch == '.'
+		}
+		last = ch
+		return ok
+	})
+}
+
+// readOption reads an option name, e.g. deprecated or (my.option)
+func readOption(l reader) string {
+	return readFunc(l, func(ch rune) bool {
+		return isLetter(ch) || isNumber(ch) || ch == '_' || ch == '.' || ch == '(' || ch == ')'
+	})
+}
+
+func readStr(l reader) string {
+	b := &bytes.Buffer{}
+	ch := l.read()
+	if ch != '"' {
+		panic("string missing opening quote")
+	}
+	b.WriteRune('"')
+
+	escaped := false
+	b.WriteString(readFunc(l, func(ch rune) bool {
+		if escaped {
+			escaped = false
+			return ch != '\n'
+		}
+		escaped = ch == '\\'
+		return ch != '"' && ch != '\n'
+	}))
+
+	ch = l.read()
+	if ch != '"' {
+		panic("string missing end quote")
+	}
+	b.WriteRune('"')
+	return b.String()
+}
+
+func readWhitespace(l reader) string {
+	b := &bytes.Buffer{}
+	for {
+		ch := l.read()
+		if ch != ' ' && ch != '\t' {
+			l.unread()
+			break
+		}
+		_, err := b.WriteRune(ch)
+		if err != nil {
+			panic(err)
+		}
+	}
+	return b.String()
+}
+
+type scanFn func(*lexer) scanFn
+
+// topLevelKeywords may start an unindented line
+var topLevelKeywords = map[string]bool{
+	"package": true,
+	"msg":     true,
+	"enum":    true,
+	"option":  true,
+	"import":  true,
+	"service": true,
+	"syntax":  true,
+	"edition": true,
+	"end":     true,
+}
+
+// fieldKeywords are keywords which would be read as the start of a
+// declaration if they were used as a field name
+var fieldKeywords = map[string]bool{
+	"option":     true,
+	"msg":        true,
+	"enum":       true,
+	"oneof":      true,
+	"service":    true,
+	"rpc":        true,
+	"reserved":   true,
+	"extensions": true,
+	"import":     true,
+	"package":    true,
+	"syntax":     true,
+	"edition":    true,
+}
+
+// fieldLineRegexp matches the rest of a field declaration after its
+// name: a type followed by a number
+var fieldLineRegexp = regexp.MustCompile(`^[A-Za-z_\[][^\s#]*\s+[0-9]`)
+
+// scan reads in an unindented line
+// package, message, comment
+func scanText(l *lexer) scanFn {
+	ch := l.read()
+	switch {
+	case ch == '\n':
+		l.emit(ItemNewline, "")
+		return scanText
+	case ch == ' ' || ch == '\t' || isLetter(ch):
+		l.unread()
+		return scanIndent
+	case ch == rune(0):
+		return nil // eof
+	case ch == l.comment:
+		l.unread()
+		return scanComment
+	default:
+		return nil // wut
+	}
+}
+
+// scanComment scans the rest of the line as a comment. A backslash at
+// the end of a comment does not continue it.
+func scanComment(l *lexer) scanFn {
+	b := &bytes.Buffer{}
+	for ch := l.readRaw(); ch != '\n' && ch != rune(0); ch = l.readRaw() {
+		b.WriteRune(ch)
+	}
+	text := strings.TrimSuffix(b.String(), "\r")
+	if strings.TrimSpace(text) == string(l.comment)+"raw" {
+		return scanRaw
+	}
+	l.emit(ItemCommentStart, text)
+	l.emit(ItemNewline, "")
+	return scanText
+}
+
+// scanRaw scans the lines after #raw up to #endraw, which are passed
+// through to the output as they are
+func scanRaw(l *lexer) scanFn {
+	start := l.line
+	end := string(l.comment) + "endraw"
+	lines := []string{}
+	for {
+		b := &bytes.Buffer{}
+		ch := l.readRaw()
+		if ch == rune(0) {
+			panic(fmt.Sprintf("line %d: %craw without %s", start, l.comment, end))
+		}
+		for ; ch != '\n' && ch != rune(0); ch = l.readRaw() {
+			b.WriteRune(ch)
+		}
+		line := strings.TrimSuffix(b.String(), "\r")
+		if strings.TrimSpace(line) == end {
+			break
+		}
+		lines = append(lines, line)
+	}
+	l.emit(ItemRaw, strings.Join(lines, "\n"))
+	l.line += len(lines) + 1
+	l.emit(ItemNewline, "")
+	return scanText
+}
+
+// scanIndent scans an indented line, which is either a comment or a
+// declaration in a block
+func scanIndent(l *lexer) scanFn {
+	ws := readWhitespace(l)
+	peek := l.read()
+	l.unread()
+	if peek == '\n' || peek == rune(0) {
+		return scanEnd // whitespace only line is just a newline
+	}
+	if len(ws) > 0 {
+		l.emit(ItemWhitespace, ws)
+	}
+	// check for comment
+	if peek == l.comment {
+		return scanEnd
+	}
+
+	if peek == '-' && len(ws) > 0 {
+		// a deleted field, which is emitted as reserved
+		l.read()
+		l.emit(ItemDeleted, "-")
+	}
+
+	identType := ItemUnknown
+	x := readAlphanum(l)
+	if l.strict && len(ws) == 0 && !topLevelKeywords[x] {
+		panic(fmt.Sprintf("line %d: unknown keyword %q", l.line, x))
+	}
+	if len(ws) > 0 && fieldKeywords[x] && fieldLineRegexp.MatchString(l.peekLine()) {
+		panic(fmt.Sprintf("line %d: %s is a keyword and can't be used as a field name, rename the field", l.line, x))
+	}
+	switch x {
+	case "option":
+		return scanFileOption
+	case "msg":
+		identType = ItemMessageType
+	case "package":
+		identType = ItemPackage
+	case "syntax":
+		identType = ItemSyntax
+	case "edition":
+		identType = ItemEdition
+	case "import":
+		return scanImport
+	case "service":
+		identType = ItemService
+	case "rpc":
+		return scanRPC
+	case "reserved":
+		return scanRanges(ItemReserved)
+	case "extensions":
+		return scanRanges(ItemExtensions)
+	case "enum":
+		identType = ItemEnum
+	case "oneof":
+		identType = ItemOneof
+	case "end":
+		// end is only a keyword on a line of its own
+		ch := l.read()
+		l.unread()
+		if ch == '\n' || ch == rune(0) || ch == l.comment {
+			l.emit(ItemBlockEnd, x)
+			return scanEnd
+		}
+		fallthrough
+	default:
+		// a comma separated list of names, e.g. enum aliases
+		for {
+			ch := l.read()
+			if ch != ',' {
+				l.unread()
+				break
+			}
+			_ = readWhitespace(l)
+			x += "," + readAlphanum(l)
+		}
+		l.emit(ItemIdentifier, x)
+		_ = readWhitespace(l)
+		return scanField
+	}
+	if identType != ItemUnknown {
+		x := readAlphanum(l)
+		l.emit(identType, x)
+		switch ch := l.read(); {
+		case ch == ':':
+			// the block ends with `end` instead of by indentation
+			l.emit(ItemBlockOpen, ":")
+			_ = readWhitespace(l)
+		case ch == '{' && identType == ItemMessageType:
+			l.emit(ItemBlockOpen, "{")
+			l.inline = true
+			return scanInline
+		default:
+			l.unread()
+		}
+		return scanEnd
+	}
+	panic("unreachable")
+}
+
+func scanFileOption(l *lexer) scanFn {
+	o := readOption(l)
+	l.emit(ItemOption, o)
+
+	_ = readWhitespace(l)
+
+	// the = is optional, as in field options
+	ch := l.read()
+	if ch == '=' {
+		_ = readWhitespace(l)
+		ch = l.read()
+	}
+	l.unread()
+	if ch == '-' || ch == '.' || isNumber(ch) {
+		l.emit(ItemNumber, readSignedNum(l))
+		return scanEnd
+	}
+	if isLetter(ch) {
+		// true, false or an enum value
+		l.emit(ItemOptionName, readAlphanum(l))
+		return scanEnd
+	}
+	s := readStr(l)
+	l.emit(ItemOptionName, s)
+	return scanEnd
+}
+
+// scanImport scans an import path, e.g. `import public "foo.proto"`
+func scanImport(l *lexer) scanFn {
+	ch := l.read()
+	l.unread()
+	if ch != '"' {
+		m := readAlphanum(l)
+		if m != "public" && m != "weak" {
+			panic(fmt.Sprintf("line %d: unknown import modifier %q", l.line, m))
+		}
+		l.emit(ItemImportModifier, m)
+	}
+	l.emit(ItemImport, readStr(l))
+	return scanEnd
+}
+
+// scanRPC scans a method, e.g. `rpc Chat stream Msg stream Msg`
+func scanRPC(l *lexer) scanFn {
+	l.emit(ItemRPC, readAlphanum(l))
+	for i := 0; i < 2; i++ {
+		t := readAlphanum(l)
+		if t == "stream" {
+			l.emit(ItemStream, t)
+			t = readAlphanum(l)
+		}
+		l.emit(ItemFieldType, t)
+	}
+	return scanEnd
+}
+
+// scanRanges scans the rest of the line as a list of ranges or names,
+// e.g. `reserved 2, 9 to 11, 100 to max`
+func scanRanges(t ItemType) scanFn {
+	return func(l *lexer) scanFn {
+		quoted := false
+		s := readFunc(l, func(ch rune) bool {
+			if ch == '"' {
+				quoted = !quoted
+			}
+			return ch != '\n' && ch != rune(0) && (quoted || ch != l.comment)
+		})
+		l.emit(t, s)
+		return scanEnd
+	}
+}
+
+func scanField(l *lexer) scanFn {
+	ch := l.read()
+	l.unread()
+	if isNumber(ch) {
+		return scanFieldNum
+	}
+	if ch == '\n' || ch == rune(0) || ch == l.comment {
+		return scanEnd // identifier only, e.g. an enum value without a number
+	}
+	return scanFieldType
+}
+
+func scanFieldType(l *lexer) scanFn {
+	l.emit(ItemFieldType, readFieldType(l))
+	ch := l.read()
+	l.unread()
+	if !isNumber(ch) {
+		return scanFieldEnd // missing number, reported by the parser
+	}
+	return scanFieldNum
+}
+
+func scanFieldNum(l *lexer) scanFn {
+	l.emit(ItemFieldNum, readNum(l))
+	return scanFieldEnd
+}
+
+func scanFieldEnd(l *lexer) scanFn {
+	_ = readWhitespace(l)
+	ch := l.read()
+	defer l.unread()
+	if ch == '[' {
+		return scanFieldOptions
+	}
+	if isLetter(ch) {
+		return scanFieldLabel
+	}
+	return scanEnd
+}
+
+// scanFieldLabel scans an explicit label following the field number,
+// e.g. the required in `name str 1 required`
+func scanFieldLabel(l *lexer) scanFn {
+	l.emit(ItemFieldLabel, readAlphanum(l))
+	return scanFieldEnd
+}
+
+func scanFieldOptions(l *lexer) scanFn {
+	ch := l.read()
+	if ch != '[' {
+		panic("expecting opening [ for option but got")
+	}
+	// brackets and # are allowed inside quoted option values, and the
+	// list may continue over several lines until the closing bracket.
+	// Values may be lists in brackets, e.g. `targets = [A, B]`.
+	quote := rune(0)
+	escaped := false
+	depth := 0
+	s := readFunc(l, func(ch rune) bool {
+		switch {
+		case ch == rune(0):
+			return false
+		case ch == '\n':
+			return quote == 0
+		case escaped:
+			escaped = false
+		case quote != 0:
+			escaped = ch == '\\'
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '"' || ch == '\'':
+			quote = ch
+		case ch == '[':
+			depth++
+		case ch == ']' && depth > 0:
+			depth--
+			return true
+		}
+		return quote != 0 || ch != ']'
+	})
+	l.emit(ItemFieldOption, s)
+	l.line += strings.Count(s, "\n")
+	ch = l.read()
+	if ch != ']' {
+		panic("expecting closing ] for option")
+	}
+	return scanFieldEnd
+}
+
+// scanInline scans the fields of a message body written on one line,
+// which are separated by semicolons and end with a closing brace. Each
+// semicolon is emitted as a newline which doesn't start a new line.
+func scanInline(l *lexer) scanFn {
+	_ = readWhitespace(l)
+	switch ch := l.read(); {
+	case ch == '}':
+		l.emit(ItemBlockEnd, "}")
+		l.inline = false
+		return scanEnd
+	case ch == ';':
+		return scanInline
+	case isLetter(ch):
+		l.unread()
+		l.emit(ItemIdentifier, readAlphanum(l))
+		return scanField
+	default:
+		panic(fmt.Sprintf("line %d: missing } at the end of an inline message", l.line))
+	}
+}
+
+// scan until end, comment or newlines
+func scanEnd(l *lexer) scanFn {
+	_ = readWhitespace(l)
+	ch := l.read()
+	if l.inline {
+		if ch == ';' {
+			l.emit(ItemNewline, ";")
+		} else {
+			l.unread()
+		}
+		return scanInline
+	}
+	if ch == ';' {
+		// a separator may end any line, as it does in one line messages
+		_ = readWhitespace(l)
+		ch = l.read()
+	}
+	if ch == l.comment {
+		l.unread()
+		return scanComment
+	}
+	if ch == '\n' {
+		l.emit(ItemNewline, "")
+		return scanText
+	}
+	if ch == rune(0) {
+		return nil // eof without a final newline
+	}
+	panic("unexpected line end " + string(ch))
+}
+
+func isLetter(ch rune) bool {
+	return (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || ch == '_'
+}
+
+func isWhitespace(ch rune) bool {
+	return ch == ' ' || ch == '\t' || ch == '\n'
+}
+
+func isNumber(ch rune) bool {
+	return ch >= '0' && ch <= '9'
+}
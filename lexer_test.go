@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+// TestLexerNext checks that NewLexer tokenizes without the parser, and
+// reports errors instead of panicking
+func TestLexerNext(t *testing.T) {
+	l := NewLexer(strings.NewReader("msg Foo\n  a str 1 # c\n"))
+	got := []string{}
+	for {
+		i, err := l.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, i.Type.String()+":"+i.Value)
+	}
+	want := "MESSAGETYPE:Foo NL: WS:   IDENT:a FIELDTYPE:str FIELDNUM:1 COMMENT:# c NL:"
+	if s := strings.Join(got, " "); s != want {
+		t.Errorf("got items %s, want %s", s, want)
+	}
+
+	l = NewLexer(strings.NewReader("msg Foo\n  a str 1 ]\n"))
+	for {
+		_, err := l.Next()
+		if err == io.EOF {
+			t.Fatal("expected an error for an unexpected ]")
+		}
+		if err != nil {
+			break
+		}
+	}
+	if _, err := l.Next(); err != io.EOF {
+		t.Errorf("expected io.EOF after an error, got %v", err)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// lintProblem is a rule violation found by the linter
+type lintProblem struct {
+	line int
+	rule string
+	msg  string
+}
+
+func (p *lintProblem) String() string {
+	return fmt.Sprintf("line %d: %s (%s)", p.line, p.msg, p.rule)
+}
+
+// lintRule checks a file for one kind of problem
+type lintRule struct {
+	id    string
+	desc  string
+	check func(f *File) []*lintProblem
+}
+
+var (
+	camelCaseRegexp  = regexp.MustCompile(`^[A-Z][A-Za-z0-9]*$`)
+	snakeCaseRegexp  = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+	upperSnakeRegexp = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+)
+
+// lintRules are all the rules, in the order they are run
+var lintRules = []*lintRule{
+	namingRule("message-naming", "message", "message names are PascalCase", camelCaseRegexp),
+	namingRule("enum-naming", "enum", "enum names are PascalCase", camelCaseRegexp),
+	namingRule("enum-value-naming", "value", "enum values are UPPER_SNAKE_CASE", upperSnakeRegexp),
+	namingRule("field-naming", "field", "field names are lower_snake_case", snakeCaseRegexp),
+	namingRule("oneof-naming", "oneof", "oneof names are lower_snake_case", snakeCaseRegexp),
+	namingRule("service-naming", "service", "service names are PascalCase", camelCaseRegexp),
+	namingRule("rpc-naming", "rpc", "rpc names are PascalCase", camelCaseRegexp),
+	{
+		id:    "field-number-gap",
+		desc:  "field numbers in a message are consecutive unless the gap is reserved",
+		check: checkFieldNumberGaps,
+	},
+}
+
+// namingRule returns a rule checking the names of one kind of node
+func namingRule(id, kind, desc string, re *regexp.Regexp) *lintRule {
+	return &lintRule{id: id, desc: desc, check: func(f *File) []*lintProblem {
+		problems := []*lintProblem{}
+		walk(f.Body, func(n node) {
+			if n.kind() != kind {
+				return
+			}
+			name, line := nodeName(n)
+			if !re.MatchString(name) {
+				problems = append(problems, &lintProblem{line: line, rule: id,
+					msg: fmt.Sprintf("%s name %q: %s", kind, name, desc)})
+			}
+		})
+		return problems
+	}}
+}
+
+// nodeName returns the name and line of a declaration
+func nodeName(n node) (string, int) {
+	switch n := n.(type) {
+	case *Message:
+		return n.Name, n.line
+	case *Enum:
+		return n.Name, n.line
+	case *EnumValue:
+		return n.Name, n.line
+	case *Field:
+		return n.Name, n.line
+	case *Oneof:
+		return n.Name, n.line
+	case *Service:
+		return n.Name, n.line
+	case *RPC:
+		return n.Name, n.line
+	}
+	return "", 0
+}
+
+// checkFieldNumberGaps reports numbers skipped between the fields of a
+// message which aren't reserved
+func checkFieldNumberGaps(f *File) []*lintProblem {
+	problems := []*lintProblem{}
+	walk(f.Body, func(n node) {
+		m, ok := n.(*Message)
+		if !ok {
+			return
+		}
+		used := []int{}
+		ranges := []*Range{}
+		for _, n := range m.Body {
+			switch n := n.(type) {
+			case *Field:
+				used = append(used, n.Number)
+			case *Oneof:
+				for _, o := range n.Body {
+					if f, ok := o.(*Field); ok {
+						used = append(used, f.Number)
+					}
+				}
+			case *Reserved:
+				ranges = append(ranges, n.Ranges...)
+			case *Extensions:
+				ranges = append(ranges, n.Ranges...)
+			}
+		}
+		sort.Ints(used)
+		covering := func(n int) *Range {
+			for _, r := range ranges {
+				if r.contains(n) {
+					return r
+				}
+			}
+			return nil
+		}
+		for i := 1; i < len(used); i++ {
+			// step over reserved ranges rather than each number in them
+			for n := used[i-1] + 1; n < used[i]; {
+				r := covering(n)
+				if r == nil {
+					problems = append(problems, &lintProblem{line: m.line, rule: "field-number-gap",
+						msg: fmt.Sprintf("message %s skips field number %d", m.Name, n)})
+					break
+				}
+				if r.Max {
+					break
+				}
+				n = r.End + 1
+			}
+		}
+	})
+	return problems
+}
+
+// lint runs the rules which aren't disabled and returns the problems
+// found, in line order. Rules disabled by directives in f are skipped
+// for the lines they apply to.
+func lint(f *File, disabled map[string]bool) []*lintProblem {
+	problems := []*lintProblem{}
+	for _, r := range lintRules {
+		if disabled[r.id] {
+			continue
+		}
+		for _, p := range r.check(f) {
+			if !f.lintDisabled(p.line, p.rule) {
+				problems = append(problems, p)
+			}
+		}
+	}
+	sort.SliceStable(problems, func(i, j int) bool {
+		return problems[i].line < problems[j].line
+	})
+	return problems
+}
+
+// disableDirective is a comment which disables lint rules for a
+// declaration, e.g. `# preto:disable field-naming`. It applies to the
+// line it ends or, on a line of its own, to the next declaration.
+// Without rule ids it disables every rule.
+const disableDirective = "preto:disable"
+
+// lintDisabled returns whether a directive disables rule on line
+func (f *File) lintDisabled(line int, rule string) bool {
+	for _, r := range f.disabled[line] {
+		if r == rule || r == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// directiveRules returns the rules disabled by a comment, or nil if it
+// isn't a directive
+func directiveRules(comment string) []string {
+	if comment != disableDirective && !strings.HasPrefix(comment, disableDirective+" ") {
+		return nil
+	}
+	rules := strings.FieldsFunc(comment[len(disableDirective):], func(ch rune) bool {
+		return ch == ',' || ch == ' '
+	})
+	if len(rules) == 0 {
+		return []string{"*"}
+	}
+	return rules
+}
+
+// collectDirectives records the lines lint directives in f apply to.
+// The directives stay in the file so that fmt keeps them; the emitter
+// leaves them out of the proto.
+func collectDirectives(f *File) {
+	f.disabled = map[int][]string{}
+	collectBodyDirectives(f.Body, f.disabled)
+}
+
+func collectBodyDirectives(b body, disabled map[int][]string) {
+	pending := []string{}
+	for _, n := range b {
+		if c, ok := n.(*Comment); ok {
+			if rules := directiveRules(c.Text); rules != nil {
+				pending = append(pending, rules...)
+				continue
+			}
+		}
+		comment, line := declComment(n)
+		if line > 0 {
+			if rules := directiveRules(comment); rules != nil {
+				disabled[line] = append(disabled[line], rules...)
+			}
+			disabled[line] = append(disabled[line], pending...)
+			pending = []string{}
+		}
+		switch n := n.(type) {
+		case *Message:
+			collectBodyDirectives(n.Body, disabled)
+		case *Enum:
+			collectBodyDirectives(n.Body, disabled)
+		case *Oneof:
+			collectBodyDirectives(n.Body, disabled)
+		case *Service:
+			collectBodyDirectives(n.Body, disabled)
+		}
+	}
+}
+
+// isDirective returns whether a comment is a lint directive, which
+// isn't copied to the output
+func isDirective(comment string) bool {
+	return directiveRules(comment) != nil
+}
+
+// declComment returns the trailing comment and line of a declaration,
+// or a zero line if n isn't one
+func declComment(n node) (string, int) {
+	switch n := n.(type) {
+	case *Message:
+		return n.Comment, n.line
+	case *Enum:
+		return n.Comment, n.line
+	case *Oneof:
+		return n.Comment, n.line
+	case *Service:
+		return n.Comment, n.line
+	case *Field:
+		return n.Comment, n.line
+	case *EnumValue:
+		return n.Comment, n.line
+	case *RPC:
+		return n.Comment, n.line
+	case *Reserved:
+		return n.Comment, n.line
+	}
+	return "", 0
+}
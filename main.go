@@ -1,659 +1,778 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"time"
+	"unicode/utf8"
 )
 
-type itemType int
+// stringList is a flag which may be given multiple times
+type stringList []string
 
-const (
-	itemUnknown itemType = iota
-	itemError
-	itemPackage
-	itemMessageType
-	itemIdentifier
-	itemCommentStart
-	itemLeftMeta
-	itemRightMeta
-	itemEqual
-	itemNumber
-	itemText
-	itemFieldType
-	itemFieldName
-	itemFieldNum
-	itemFieldOption
-	itemNewline
-	itemWhitespace
-	itemOption
-	itemOptionName
-	itemEnum
-	itemOneof
-)
-
-func (i itemType) String() string {
-	switch i {
-	case itemError:
-		return "ERROR"
-	case itemPackage:
-		return "PACKAGE"
-	case itemMessageType:
-		return "MESSAGETYPE"
-	case itemIdentifier:
-		return "IDENT"
-	case itemCommentStart:
-		return "COMMENT"
-	case itemFieldType:
-		return "FIELDTYPE"
-	case itemFieldName:
-		return "FIELDNAME"
-	case itemFieldOption:
-		return "FIELDOPTION"
-	case itemFieldNum:
-		return "FIELDNUM"
-	case itemNewline:
-		return "NL"
-	case itemWhitespace:
-		return "WS"
-	case itemOption:
-		return "OPTIONTYPE"
-	case itemOptionName:
-		return "OPTIONVAL"
-	default:
-		return "LOL"
-	}
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
 }
-func main() {
-	fn := os.Args[1]
-	f, err := os.Open(fn)
-	if err != nil {
-		panic(err)
-	}
 
-	l := lexer{buf: bufio.NewReader(f), c: make(chan item)}
-	go l.lex()
-	p := parser{w: os.Stdout, c: l.c}
-	p.parse()
-	// for s := range l.c {
-	// 	fmt.Printf("%s: %q\n", s.t, s.s)
-	// }
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
 }
 
-type lexer struct {
-	buf *bufio.Reader
-	c   chan item
-}
+// exit codes, so that scripts can tell errors from warnings
+const (
+	exitParseError = 1 // the file couldn't be parsed, or another failure
+	exitInvalid    = 2 // the file parsed but protoc would reject it
+	exitWarnings   = 3 // warnings were found and -Werror was given
+)
 
-type item struct {
-	t itemType
-	s string
-}
+// warningCount is the number of warnings printed by warnf
+var warningCount = 0
 
-func (l *lexer) emit(t itemType, s string) {
-	l.c <- item{t, s}
-}
+// quiet is set by -quiet to print nothing but errors and output
+var quiet = false
 
-func (l *lexer) read() rune {
-	ch, _, err := l.buf.ReadRune()
-	if err == io.EOF {
-		return rune(0)
+// warnf prints a warning to stderr. With -quiet it is only counted.
+func warnf(format string, args ...interface{}) {
+	warningCount++
+	if !quiet {
+		fmt.Fprintf(os.Stderr, "warning: "+format+"\n", args...)
 	}
-	if err != nil {
-		panic(err)
-	}
-	return ch
 }
 
-func (l *lexer) unread() {
-	_ = l.buf.UnreadRune()
+// infof prints a progress message to stdout, unless -quiet is given
+func infof(format string, args ...interface{}) {
+	if !quiet {
+		fmt.Printf(format+"\n", args...)
+	}
 }
 
-func (l *lexer) lex() {
-	state := scanText
-	for state != nil {
-		state = state(l)
+// exitError prints err and exits with exitInvalid if the file was
+// invalid or exitParseError otherwise
+func exitError(err error) {
+	printErrors(err)
+	var invalid *invalidError
+	if errors.As(err, &invalid) {
+		os.Exit(exitInvalid)
 	}
-	close(l.c)
+	os.Exit(exitParseError)
 }
 
-type reader interface {
-	read() rune
-	unread()
+// commands are the subcommands, chosen by the first argument. Without
+// one preto converts the file.
+var commands = map[string]func(args []string){
+	"convert": convertCmd,
+	"fmt":     fmtCmd,
+	"check":   checkCmd,
+	"lint":    lintCmd,
+	"init":    initCmd,
+	"watch":   watchCmd,
+	"compat":  compatCmd,
 }
 
-func readFunc(l reader, ok func(rune) bool) string {
-	b := &bytes.Buffer{}
-	for {
-		ch := l.read()
-		if !ok(ch) {
-			l.unread()
-			break
-		}
-		_, err := b.WriteRune(ch)
-		if err != nil {
-			panic(err)
+func main() {
+	args := os.Args[1:]
+	cmd := convertCmd
+	if len(args) > 0 {
+		if c, ok := commands[args[0]]; ok {
+			cmd, args = c, args[1:]
 		}
 	}
-	// consume whitespaces until we have no more
-	_ = readWhitespace(l)
-	return b.String()
+	cmd(args)
 }
 
-func readNum(l reader) string {
-	return readFunc(l, isNumber)
+// parseFlags are the flags shared by the commands which parse a file
+type parseFlags struct {
+	commentChar   *string
+	strict        *bool
+	trace         *bool
+	warnFieldCost *bool
+	exactComments *bool
+	warnEmpty     *bool
+	tabWidth      *int
+	werror        *bool
+	requirePkg    *bool
+	defaultPkg    *string
 }
 
-func readAlphanum(l reader) string {
-	return readFunc(l, func(ch rune) bool {
-		return isLetter(ch) || isNumber(ch) || ch == '_' || ch == '.'
-	})
+func addParseFlags(fs *flag.FlagSet) *parseFlags {
+	fs.BoolVar(&quiet, "quiet", false, "only print errors, not warnings or progress")
+	fs.BoolVar(&quiet, "q", false, "short for -quiet")
+	return &parseFlags{
+		commentChar:   fs.String("comment-char", "#", "character which starts a comment"),
+		strict:        fs.Bool("strict", false, "reject unindented lines which don't start with a keyword"),
+		trace:         fs.Bool("trace", false, "log parser calls and tokens to stderr"),
+		warnFieldCost: fs.Bool("warn-field-number-cost", false, "warn about repeated and map fields numbered above 15"),
+		werror:        fs.Bool("Werror", false, "exit with status 3 if there are any warnings"),
+		tabWidth:      fs.Int("tab-width", 4, "number of columns a tab in indentation counts as"),
+		warnEmpty:     fs.Bool("warn-empty", false, "warn about messages, enums and oneofs with nothing in them"),
+		exactComments: fs.Bool("exact-comments", false, "keep comment indentation, only removing the comment character and one space"),
+		requirePkg:    fs.Bool("require-package", false, "fail if the file doesn't declare a package"),
+		defaultPkg:    fs.String("default-package", "", "package to declare in files which don't declare one"),
+	}
 }
 
-func readFieldType(l reader) string {
-	return readFunc(l, func(ch rune) bool {
-		return isLetter(ch) || isNumber(ch) || ch == '_' || ch == '[' || ch == ']'
-	})
-}
-func readOption(l reader) string {
-	return readFunc(l, func(ch rune) bool {
-		return isLetter(ch) || isNumber(ch) || ch == '_' || ch == '(' || ch == ')'
-	})
+// comment returns the comment character, exiting if it is invalid
+func (pf *parseFlags) comment() rune {
+	comment, size := utf8.DecodeRuneInString(*pf.commentChar)
+	if size == 0 || size != len(*pf.commentChar) {
+		fmt.Fprintln(os.Stderr, "error: -comment-char must be a single character")
+		os.Exit(1)
+	}
+	return comment
 }
 
-func readStr(l reader) string {
-	b := &bytes.Buffer{}
-	ch := l.read()
-	if ch != '"' {
-		panic("string missing opening quote")
+func (pf *parseFlags) options() []ConvertOption {
+	opts := []ConvertOption{WithCommentChar(pf.comment()), WithTabWidth(*pf.tabWidth)}
+	if *pf.strict {
+		opts = append(opts, WithStrict())
 	}
-	b.WriteRune('"')
-
-	b.WriteString(readFunc(l, func(ch rune) bool {
-		return ch != '"' && ch != '\n'
-	}))
-
-	ch = l.read()
-	if ch != '"' {
-		panic("string missing end quote")
+	if *pf.trace {
+		opts = append(opts, WithTrace(os.Stderr))
+	}
+	if *pf.warnFieldCost {
+		opts = append(opts, WithWarnFieldNumberCost())
+	}
+	if *pf.exactComments {
+		opts = append(opts, WithExactComments())
+	}
+	if *pf.warnEmpty {
+		opts = append(opts, WithWarnEmpty())
+	}
+	if *pf.requirePkg {
+		opts = append(opts, WithRequirePackage())
+	}
+	if *pf.defaultPkg != "" {
+		opts = append(opts, WithDefaultPackage(*pf.defaultPkg))
 	}
-	b.WriteRune('"')
-	return b.String()
+	return opts
 }
 
-func readWhitespace(l reader) string {
-	b := &bytes.Buffer{}
-	for {
-		ch := l.read()
-		if ch != ' ' && ch != '\t' {
-			l.unread()
-			break
+// parseFile parses fn with its includes expanded, exiting if it has
+// errors
+func (pf *parseFlags) parseFile(fn string, opts ...ConvertOption) *File {
+	src, lines, err := expandIncludes(fn, pf.comment())
+	if err != nil {
+		printErrors(err)
+		os.Exit(1)
+	}
+	file, err := Parse(bytes.NewReader(src), append(pf.options(), opts...)...)
+	if err != nil {
+		exitError(lines.translateErr(err))
+	}
+	file.lines = lines
+	for _, w := range file.Warnings() {
+		warnf("%s", lines.translate(w))
+	}
+	return file
+}
+
+// exitOnWarnings exits with exitWarnings if -Werror was given and any
+// warnings were printed
+func (pf *parseFlags) exitOnWarnings() {
+	if *pf.werror && warningCount > 0 {
+		os.Exit(exitWarnings)
+	}
+}
+
+// defaultHeader is the comment written at the top of output files
+const defaultHeader = "Code generated by preto; DO NOT EDIT."
+
+// convertCmd converts a preto file to proto
+func convertCmd(args []string) {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	pf := addParseFlags(fs)
+	protoPaths := stringList{}
+	fs.Var(&protoPaths, "proto-path", "directory to search for imports in, may be repeated")
+	stripComments := fs.Bool("strip-comments", false, "omit comments from the output")
+	dumpJSON := fs.Bool("json", false, "print the parsed file as JSON instead of proto, the same as -output-format json")
+	outputFormat := fs.String("output-format", "proto", "what to print: proto, json for the parsed file or textpb for a FileDescriptorProto")
+	sortByNumber := fs.Bool("sort-fields", false, "emit fields in field number order")
+	docsPath := fs.String("docs", "", "write comments keyed by declaration as JSON to this file")
+	emitSyntaxes := fs.String("emit", "", "comma separated syntaxes to write, each to its own file, e.g. proto2,proto3")
+	styleName := fs.String("style", "default", "output style: default or google")
+	splitDir := fs.String("split", "", "write each toplevel declaration to <package path>/<Name>.proto under this directory")
+	packRepeated := fs.Bool("pack-repeated", false, "add packed = true to repeated scalar fields in proto2")
+	header := fs.String("header", defaultHeader, "comment to write at the top of each output file")
+	noHeader := fs.Bool("no-header", false, "don't write a header comment")
+	noOptional := fs.Bool("no-optional", false, "leave out optional on singular scalar fields in proto2")
+	crlf := fs.Bool("crlf", false, "end lines with \\r\\n instead of \\n")
+	goPackageBase := fs.String("go-package-base", "", "add option go_package using this import path and the package name")
+	planOnly := fs.Bool("plan", false, "print the files -split, -emit and -docs would write and their sizes without writing them")
+	force := fs.Bool("force", false, "rewrite output files even if they are newer than the source")
+	fs.Parse(args)
+
+	st, ok := styles[*styleName]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "error: unknown style %q\n", *styleName)
+		os.Exit(1)
+	}
+	if *noHeader {
+		*header = ""
+	}
+	if *dumpJSON {
+		*outputFormat = "json"
+	}
+	if *outputFormat != "proto" && *outputFormat != "json" && *outputFormat != "textpb" {
+		fmt.Fprintf(os.Stderr, "error: unknown output format %q\n", *outputFormat)
+		os.Exit(1)
+	}
+	// newEmitter returns an emitter for w with the output flags applied
+	eol := "\n"
+	if *crlf {
+		eol = "\r\n"
+	}
+	newEmitter := func(w io.Writer) *emitter {
+		return &emitter{w: w, stripComments: *stripComments, style: st, packRepeated: *packRepeated, header: *header,
+			eol: eol}
+	}
+
+	write := writeFile
+	planned := []string{}
+	if *planOnly {
+		if *splitDir == "" && *emitSyntaxes == "" && *docsPath == "" {
+			fmt.Fprintln(os.Stderr, "error: -plan needs -split, -emit or -docs")
+			os.Exit(1)
 		}
-		_, err := b.WriteRune(ch)
-		if err != nil {
-			panic(err)
+		write = func(fn string, data []byte) error {
+			planned = append(planned, fmt.Sprintf("%s (%.1f KB)", fn, float64(len(data))/1024))
+			return nil
 		}
 	}
-	return b.String()
-}
-
-type scanFn func(*lexer) scanFn
 
-// scan reads in an unindented line
-// package, message, comment
-func scanText(l *lexer) scanFn {
-	ch := l.read()
-	switch {
-	case ch == '\n':
-		l.emit(itemNewline, "")
-		return scanText
-	case ch == ' ' || ch == '\t' || isLetter(ch):
-		l.unread()
-		return scanIndent
-	case ch == rune(0):
-		return nil // eof
-	case ch == '#':
-		l.unread()
-		return scanComment
-	default:
-		return nil // wut
+	fn := fs.Arg(0)
+	parseOpts := []ConvertOption{}
+	if *noOptional {
+		parseOpts = append(parseOpts, WithNoOptional())
 	}
-}
-
-func scanComment(l *lexer) scanFn {
-	b, isPrefix, err := l.buf.ReadLine()
-	if isPrefix {
-		panic("not handled: read line is prefix")
+	file := pf.parseFile(fn, parseOpts...)
+	if !*force {
+		// skip outputs written since the source, and the files it
+		// includes, last changed
+		modified, err := sourceModTime(fn, pf.comment())
+		if err != nil {
+			exitError(err)
+		}
+		next := write
+		write = func(out string, data []byte) error {
+			if fi, err := os.Stat(out); err == nil && !fi.ModTime().Before(modified) {
+				return nil
+			}
+			return next(out, data)
+		}
 	}
-	if err != nil {
-		panic(err)
+	if *sortByNumber {
+		sortFields(file)
 	}
-	l.emit(itemCommentStart, string(b))
-	l.emit(itemNewline, "")
-	return scanText
-}
-
-// scanField scans an indented line, which is either a comment or a field
-// todo: nested message, oneof, option, extensions
-// todo: enum
-func scanIndent(l *lexer) scanFn {
-	ws := readWhitespace(l)
-	if len(ws) > 0 {
-		l.emit(itemWhitespace, ws)
+	if *goPackageBase != "" {
+		addGoPackage(file, *goPackageBase)
 	}
-	// check for comment
-	peek := l.read()
-	l.unread()
-	if peek == '#' {
-		return scanEnd // todo: scanComment?
+	if *docsPath != "" {
+		b, err := json.MarshalIndent(extractDocs(file), "", "  ")
+		if err != nil {
+			panic(err)
+		}
+		if err := write(*docsPath, append(b, '\n')); err != nil {
+			panic(err)
+		}
 	}
-
-	identType := itemUnknown
-	x := readAlphanum(l)
-	switch x {
-	case "option":
-		return scanFileOption
-	case "msg":
-		identType = itemMessageType
-	case "package":
-		identType = itemPackage
-	case "enum":
-		identType = itemEnum
-	case "oneof":
-		identType = itemOneof
-	default:
-		l.emit(itemIdentifier, x)
-		_ = readWhitespace(l)
-		return scanField
+	if *outputFormat == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(file); err != nil {
+			panic(err)
+		}
+	} else if *outputFormat == "textpb" {
+		writeDescriptor(os.Stdout, file, strings.TrimSuffix(filepath.Base(fn), ".preto")+".proto")
+	} else if *splitDir != "" {
+		for _, d := range splitFile(file, protoPaths) {
+			if err := writeProto(filepath.Join(*splitDir, d.path), d.file, newEmitter, write); err != nil {
+				printErrors(err)
+				os.Exit(1)
+			}
+		}
+	} else if *emitSyntaxes != "" {
+		for _, syntax := range strings.Split(*emitSyntaxes, ",") {
+			if err := emitSyntax(file, fn, syntax, newEmitter, write); err != nil {
+				exitError(err)
+			}
+		}
+	} else if !*planOnly {
+		if err := newEmitter(os.Stdout).emit(file); err != nil {
+			exitError(err)
+		}
 	}
-	if identType != itemUnknown {
-		x := readAlphanum(l)
-		l.emit(identType, x)
-		return scanEnd
+	for _, p := range planned {
+		infof("would write %s", p)
 	}
-	panic("unreachable")
-}
-
-func scanFileOption(l *lexer) scanFn {
-	o := readOption(l)
-	l.emit(itemOption, o)
-
-	_ = readWhitespace(l)
-
-	s := readStr(l)
-	l.emit(itemOptionName, s)
-	return scanEnd
-}
-
-func scanField(l *lexer) scanFn {
-	ch := l.read()
-	l.unread()
-	if isNumber(ch) {
-		return scanFieldNum
+	if len(protoPaths) > 0 {
+		for _, imp := range missingImports(file.userImports(), protoPaths) {
+			warnf("import %q not found in proto path", imp)
+		}
 	}
-	return scanFieldType
-}
-
-func scanFieldType(l *lexer) scanFn {
-	l.emit(itemFieldType, readFieldType(l))
-	return scanFieldNum
+	if st.checkNames {
+		for _, w := range styleWarnings(file) {
+			warnf("%s", file.lines.translate(w))
+		}
+	}
+	if unused := unusedImports(file, protoPaths); len(unused) > 0 {
+		warnf("unused imports: %s", strings.Join(unused, ", "))
+	}
+	if imported, ok := importedTypes(file, protoPaths); ok {
+		for _, w := range unknownTypes(file, imported) {
+			warnf("%s", file.lines.translate(w))
+		}
+	}
+	pf.exitOnWarnings()
 }
 
-func scanFieldNum(l *lexer) scanFn {
-	l.emit(itemFieldNum, readNum(l))
-	return scanFieldEnd
+// importedTypes returns the types declared by the imports of f. It
+// returns false if an import can't be read, since then any type could
+// come from it.
+func importedTypes(f *File, protoPaths []string) (map[string]bool, bool) {
+	types := map[string]bool{}
+	for _, imp := range f.imports() {
+		decls := importDecls(imp, protoPaths)
+		if len(decls) == 0 {
+			return nil, false
+		}
+		for t := range decls {
+			types[t] = true
+		}
+	}
+	return types, true
 }
 
-func scanFieldEnd(l *lexer) scanFn {
-	_ = readWhitespace(l)
-	ch := l.read()
-	defer l.unread()
-	if ch == '[' {
-		return scanFieldOptions
+// checkCmd reports errors in preto files without converting them
+func checkCmd(args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	pf := addParseFlags(fs)
+	fs.Parse(args)
+	for _, fn := range fs.Args() {
+		pf.parseFile(fn)
 	}
-	return scanEnd
+	pf.exitOnWarnings()
 }
 
-func scanFieldOptions(l *lexer) scanFn {
-	ch := l.read()
-	if ch != '[' {
-		panic("expecting opening [ for option but got")
+// lintCmd reports problems found by the lint rules in preto files
+func lintCmd(args []string) {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	pf := addParseFlags(fs)
+	disable := fs.String("disable", "", "comma separated ids of rules to skip")
+	listRules := fs.Bool("rules", false, "list the rules and exit")
+	fs.Parse(args)
+
+	if *listRules {
+		for _, r := range lintRules {
+			fmt.Printf("%-18s %s\n", r.id, r.desc)
+		}
+		return
 	}
-	s := readFunc(l, func(ch rune) bool {
-		return ch != ']' && ch != '\n'
-	})
-	l.emit(itemFieldOption, s)
-	ch = l.read()
-	if ch != ']' {
-		panic("expecting opening ] for option")
+	known := map[string]bool{}
+	for _, r := range lintRules {
+		known[r.id] = true
 	}
-	return scanEnd
-}
-
-// scan until end, comment or newlines
-func scanEnd(l *lexer) scanFn {
-	_ = readWhitespace(l)
-	ch := l.read()
-	if ch == '#' {
-		l.unread()
-		return scanComment
+	disabled := map[string]bool{}
+	for _, id := range strings.Split(*disable, ",") {
+		if id = strings.TrimSpace(id); id == "" {
+			continue
+		}
+		if !known[id] {
+			fmt.Fprintf(os.Stderr, "error: unknown lint rule %q\n", id)
+			os.Exit(1)
+		}
+		disabled[id] = true
+	}
+	failed := false
+	for _, fn := range fs.Args() {
+		file := pf.parseFile(fn)
+		for _, p := range lint(file, disabled) {
+			src, line := file.lines.position(p.line)
+			fmt.Fprintf(os.Stderr, "%s:%d: %s (%s)\n", src, line, p.msg, p.rule)
+			failed = true
+		}
 	}
-	if ch == '\n' {
-		l.emit(itemNewline, "")
-		return scanText
+	if failed {
+		// lint problems are style warnings rather than errors
+		os.Exit(exitWarnings)
 	}
-	panic("unexpected line end " + string(ch))
-}
-
-func isLetter(ch rune) bool {
-	return (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || ch == '_'
-}
-
-func isWhitespace(ch rune) bool {
-	return ch == ' ' || ch == '\t' || ch == '\n'
 }
 
-func isNumber(ch rune) bool {
-	return ch >= '0' && ch <= '9'
+// fmtCmd rewrites preto files in a standard layout. Includes aren't
+// expanded, since that would paste them into the rewritten file.
+func fmtCmd(args []string) {
+	fs := flag.NewFlagSet("fmt", flag.ExitOnError)
+	pf := addParseFlags(fs)
+	write := fs.Bool("w", false, "write the result to the file instead of stdout")
+	fs.Parse(args)
+	for _, fn := range fs.Args() {
+		f, err := os.Open(fn)
+		if err != nil {
+			printErrors(err)
+			os.Exit(1)
+		}
+		file, err := Parse(f, pf.options()...)
+		f.Close()
+		if err != nil {
+			exitError(err)
+		}
+		for _, w := range file.Warnings() {
+			warnf("%s: %s", fn, w)
+		}
+		out := &bytes.Buffer{}
+		fm := formatter{w: out, comment: pf.comment()}
+		fm.format(file)
+		if !*write {
+			os.Stdout.Write(out.Bytes())
+			continue
+		}
+		if err := os.WriteFile(fn, out.Bytes(), 0644); err != nil {
+			printErrors(err)
+			os.Exit(1)
+		}
+	}
+	pf.exitOnWarnings()
 }
 
-// PARSER
+// initTemplate is the starter file written by init, filled in with the
+// package and message names
+const initTemplate = `syntax proto3
+package %s
 
-type parser struct {
-	c    <-chan item
-	head *item
-	w    io.Writer
+# %s is an example message. Fields are written as name, type and number.
+msg %s
+  id str 1
+  tags []str 2
+  created i64 3
+`
 
-	line   int
-	indent int
-}
+// initCmd writes a starter preto file declaring a message named by the
+// argument
+func initCmd(args []string) {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	out := fs.String("o", "", "file to write instead of stdout; it must not exist")
+	pkg := fs.String("package", "", "package name, the lowercased message name by default")
+	fs.Parse(args)
 
-// return the next item. what to do when channel closes?
-func (p *parser) next() item {
-	o := item{}
-	if p.head != nil {
-		o = *p.head
-		p.head = nil
-	} else {
-		o = <-p.c
+	name := fs.Arg(0)
+	if !identRegexp.MatchString(name) {
+		fmt.Fprintln(os.Stderr, "usage: preto init [-o file.preto] [-package name] MessageName")
+		os.Exit(1)
+	}
+	if *pkg == "" {
+		*pkg = strings.ToLower(name)
+	}
+	src := fmt.Sprintf(initTemplate, *pkg, name, name)
+	if *out == "" {
+		fmt.Print(src)
+		return
+	}
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err == nil {
+		_, err = f.WriteString(src)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		printErrors(err)
+		os.Exit(1)
 	}
-	// fmt.Println(">> ", o.t.String(), o.s)
-	return o
 }
 
-// peek at the next item
-func (p *parser) peek() item {
-	if p.head != nil {
-		return *p.head
+// compatCmd reports the changes between an old and a new version of a
+// schema which break wire compatibility. Either may be a .proto file.
+func compatCmd(args []string) {
+	fs := flag.NewFlagSet("compat", flag.ExitOnError)
+	pf := addParseFlags(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, "usage: preto compat old.proto new.pb")
+		os.Exit(1)
+	}
+	problems := compat(pf.parseSchema(fs.Arg(0)), pf.parseSchema(fs.Arg(1)))
+	for _, p := range problems {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", fs.Arg(1), p)
+	}
+	if len(problems) > 0 {
+		os.Exit(exitWarnings)
 	}
-	i := p.next()
-	p.head = &i
-	return i
 }
 
-func (p *parser) write(lvl int, s string) {
-	l := strings.Repeat(indentSpace, lvl)
-	p.w.Write([]byte(l + s))
+// parseSchema parses a preto file, or a proto file if fn ends in
+// .proto, exiting if it has errors
+func (pf *parseFlags) parseSchema(fn string) *File {
+	if filepath.Ext(fn) != ".proto" {
+		return pf.parseFile(fn)
+	}
+	src, err := os.ReadFile(fn)
+	if err == nil {
+		var f *File
+		if f, err = parseProto(string(src)); err == nil {
+			return f
+		}
+		err = fmt.Errorf("%s: %w", fn, err)
+	}
+	printErrors(err)
+	os.Exit(exitParseError)
+	return nil
 }
 
-const indentSpace = "  "
-
-func (p *parser) writef(lvl int, f string, args ...interface{}) {
-	p.write(lvl, fmt.Sprintf(f, args...))
-}
+// watchCmd converts each preto file under a directory to a proto file
+// next to it whenever it, or a file it includes, changes. It polls for
+// changes until interrupted.
+func watchCmd(args []string) {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	pf := addParseFlags(fs)
+	interval := fs.Duration("interval", 500*time.Millisecond, "how often to check for changes")
+	fs.Parse(args)
 
-// toplevel parse
-func (p *parser) parse() {
+	dir := fs.Arg(0)
+	if dir == "" {
+		dir = "."
+	}
+	comment := pf.comment()
+	converted := map[string]time.Time{}
 	for {
-		i := p.peek()
-		switch i.t {
-		case itemUnknown:
-			return
-		case itemNewline:
-			p.write(0, "\n")
-			p.line++
-			p.next()
-		case itemWhitespace:
-			p.parseNewline()
-		case itemPackage:
-			p.writef(0, "package %s;", i.s)
-			p.next()
-		case itemOption:
-			j := <-p.c
-			if j.t != itemOptionName {
-				panic("parser: expected option value")
+		err := filepath.Walk(dir, func(fn string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() || filepath.Ext(fn) != ".preto" {
+				return err
+			}
+			modified, err := sourceModTime(fn, comment)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s:\n", fn)
+				printErrors(err)
+				return nil
+			}
+			if t, ok := converted[fn]; ok && !modified.After(t) {
+				return nil
 			}
-			p.writef(0, "option %s = %s;", i.s, j.s)
-			p.next()
-		case itemEnum:
-			// parseEnum()
-		case itemCommentStart:
-			// printComment(i)
-		case itemMessageType:
-			p.parseMessage(0)
+			converted[fn] = modified
+			out := strings.TrimSuffix(fn, filepath.Ext(fn)) + ".proto"
+			if err := watchConvert(fn, out, pf); err != nil {
+				fmt.Fprintf(os.Stderr, "%s:\n", fn)
+				printErrors(err)
+				return nil
+			}
+			infof("%s converted to %s", fn, out)
+			return nil
+		})
+		if err != nil {
+			printErrors(err)
+			os.Exit(1)
 		}
+		time.Sleep(*interval)
 	}
-	p.write(0, "\n")
 }
 
-func (p *parser) consumeNewlines() {
-	for p.peek().t == itemNewline {
-		p.next()
-		// p.line++ // ??
-		// p.indent = 0
+// watchConvert converts fn to out, printing any warnings
+func watchConvert(fn, out string, pf *parseFlags) error {
+	src, lines, err := expandIncludes(fn, pf.comment())
+	if err != nil {
+		return err
 	}
-}
-
-func (p *parser) parseNewline() {
-	nl := p.next()
-	for nl.t == itemWhitespace {
-		nl = p.next()
+	file, err := Parse(bytes.NewReader(src), pf.options()...)
+	if err != nil {
+		return lines.translateErr(err)
+	}
+	for _, w := range file.Warnings() {
+		warnf("%s: %s", fn, lines.translate(w))
 	}
-	if nl.t != itemNewline {
-		panic("parser: expected newline, got " + nl.t.String())
+	newEmitter := func(w io.Writer) *emitter {
+		return &emitter{w: w, style: styles["default"], header: defaultHeader}
 	}
-	p.write(0, "\n")
-	p.line++
-	p.indent = 0
+	return writeProto(out, file, newEmitter, writeFile)
 }
 
-func (p *parser) parseMessage(lvl int) {
-	i := p.next()
-	if i.t != itemMessageType {
-		panic("expected message type")
+// emitSyntax writes file as the given syntax to a file named after fn,
+// e.g. foo_proto3.proto for foo.preto
+func emitSyntax(file *File, fn, syntax string, newEmitter func(io.Writer) *emitter, write outputFunc) error {
+	if syntax != "proto2" && syntax != "proto3" {
+		return fmt.Errorf("unknown syntax %q", syntax)
 	}
-	p.writef(lvl, "message %s {", i.s)
-	p.parseNewline()
-	messageLevel := 0
-	for {
-		j := p.peek()
-		if j.t == itemNewline {
-			p.consumeNewlines()
-			continue
-		}
-		if j.t != itemWhitespace {
-			break
+	for _, n := range file.Body {
+		if _, ok := n.(*Edition); ok {
+			return fmt.Errorf("can't emit an editions file as %s", syntax)
 		}
-		// basically in here we wanted something
-		// indented, either a field or enum or oneof or message
-		if messageLevel == 0 {
-			messageLevel = len(j.s)
-		}
-		if len(j.s) < messageLevel {
-			break
+	}
+	if syntax == "proto3" {
+		errs := []error{}
+		walk(file.Body, func(n node) {
+			if f, ok := n.(*Field); ok && f.Label == "required" {
+				errs = append(errs, fmt.Errorf("proto3: field %s cannot be required", f.Name))
+			}
+		})
+		if len(errs) > 0 {
+			return &invalidError{errs}
 		}
-		p.next()
-		p.parseMessageInner(messageLevel)
 	}
-	p.write(lvl, "}\n")
+	out := strings.TrimSuffix(fn, filepath.Ext(fn)) + "_" + syntax + ".proto"
+	buf := &bytes.Buffer{}
+	e := newEmitter(buf)
+	e.syntax = syntax
+	if err := e.emit(file); err != nil {
+		return err
+	}
+	return write(out, buf.Bytes())
 }
 
-func toProtoType(t string) string {
-	switch t {
-	case "str":
-		return "string"
+// writeProto emits file to fn
+func writeProto(fn string, file *File, newEmitter func(io.Writer) *emitter, write outputFunc) error {
+	buf := &bytes.Buffer{}
+	if err := newEmitter(buf).emit(file); err != nil {
+		return err
 	}
-	return t
+	return write(fn, buf.Bytes())
 }
 
-func convertType(s string) string {
-	if strings.HasPrefix(s, "map[") {
-		i := strings.Index(s, "]")
-		s = fmt.Sprintf("map<%s, %s>",
-			toProtoType(s[4:i]),
-			toProtoType(s[i+1:]),
-		)
-		return s
-	}
+// outputFunc writes an output file. With -plan it records the file
+// instead.
+type outputFunc func(fn string, data []byte) error
 
-	o := "optional"
-	if strings.HasPrefix(s, "[]") {
-		o = "repeated"
-		s = toProtoType(s[2:])
-	} else {
-		s = toProtoType(s)
+// writeFile writes data to fn, creating its directory if needed
+func writeFile(fn string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return err
 	}
-	return o + " " + s
+	return os.WriteFile(fn, data, 0644)
 }
 
-func (p *parser) parseMessageInner(lvl int) {
-	i := p.peek()
-	switch i.t {
-	case itemCommentStart:
-		p.writef(lvl, "// %s", strings.TrimLeft(i.s, "# "))
-		p.next()
-		p.parseNewline()
-		return
-	case itemIdentifier: // IDENT FIELDTYPE FIELDNUM
-		p.parseField(lvl)
-	case itemEnum:
-		p.parseEnum(lvl)
-	case itemMessageType:
-		p.parseMessage(lvl)
-	case itemOneof:
-		p.parseOneof(lvl)
-	case itemNewline:
-		break
-	default:
-		panic("parser: unknown message contents" + i.t.String())
-	}
-}
-
-func (p *parser) parseField(lvl int) {
-	ident := p.next() // consume the peeked token
-	if ident.t != itemIdentifier {
-		panic("expected identifier")
-	}
-	fieldType := p.next()
-	if fieldType.t != itemFieldType {
-		panic("parser: expected field type but got " + fieldType.t.String())
-	}
-	fieldNum := p.next()
-	if fieldNum.t != itemFieldNum {
-		panic("parser expected field num")
-	}
-	p.writef(lvl, "%s %s = %s", convertType(fieldType.s), ident.s, fieldNum.s)
-
-	// parse remainder of line
-	rem := p.next()
-	if rem.t == itemFieldOption {
-		p.writef(0, " [%s]", rem.s)
-		rem = p.next()
-	}
-
-	switch rem.t {
-	case itemCommentStart:
-		p.writef(0, "; // %s", strings.TrimLeft(rem.s, "# "))
-		p.parseNewline()
-		return
-	case itemNewline:
-		p.write(0, ";\n")
-		p.line++
+// printErrors prints each of the errors joined in err
+func printErrors(err error) {
+	if errs, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, err := range errs.Unwrap() {
+			printErrors(err)
+		}
 		return
-	default:
-		panic("parser: unknown field comment")
 	}
+	fmt.Fprintln(os.Stderr, "error:", err)
 }
 
-func (p *parser) parseEnum(lvl int) {
-	i := p.next()
-	if i.t != itemEnum {
-		panic("expected enum type")
+// missingImports returns the imports which cannot be found relative
+// to any of the given proto paths
+func missingImports(imports, protoPaths []string) []string {
+	missing := []string{}
+	for _, imp := range imports {
+		found := false
+		for _, root := range protoPaths {
+			if _, err := os.Stat(filepath.Join(root, imp)); err == nil {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, imp)
+		}
 	}
-	p.writef(lvl, "enum %s {", i.s)
-	p.parseNewline()
+	return missing
+}
 
-	// expect WS IDENT FIELDNUM (COMMENT) NEWLINE
-	// expect WS COMMENT NEWLINE
-	// expect WS NEWLINE
-	messageLevel := 0
-	for {
-		j := p.peek()
-		if j.t == itemNewline {
-			p.next()
+// unusedImports returns the imports which don't define any type used in
+// f. Well known imports are always checked; other imports are only
+// checked if they can be found in the proto path.
+func unusedImports(f *File, protoPaths []string) []string {
+	refs := f.typeRefs()
+	unused := []string{}
+	for _, n := range f.Body {
+		i, ok := n.(*Import)
+		if !ok || i.Modifier == "public" {
+			// public imports are for files which import this one
 			continue
 		}
-		if j.t != itemWhitespace {
-			break
+		imp := i.Path
+		decls := importDecls(imp, protoPaths)
+		if len(decls) > 0 && !usesDecls(refs, decls) {
+			unused = append(unused, imp)
 		}
-		if messageLevel == 0 {
-			messageLevel = len(j.s)
+	}
+	return unused
+}
+
+// importDecls returns the types declared by an import, or nil if the
+// import isn't well known and can't be found in the proto path
+func importDecls(imp string, protoPaths []string) map[string]bool {
+	for _, root := range protoPaths {
+		b, err := os.ReadFile(filepath.Join(root, imp))
+		if err == nil {
+			return declaredTypes(string(b))
 		}
-		if len(j.s) < messageLevel {
-			// bug: actually okay if the next thing is a newline?
-			break
+	}
+	decls := map[string]bool{}
+	for t, path := range wellKnownTypes {
+		if path == imp {
+			decls[t] = true
 		}
-		p.next() // consume ws
-		j = p.next()
-		if j.t == itemIdentifier {
-			k := p.next()
-			if k.t != itemFieldNum {
-				panic("expected field num")
+	}
+	return decls
+}
+
+// usesDecls returns whether any of the type references refer to one of
+// the declared types
+func usesDecls(refs []string, decls map[string]bool) bool {
+	for _, ref := range refs {
+		ref = strings.TrimPrefix(ref, ".")
+		for d := range decls {
+			if d == ref || strings.HasSuffix(d, "."+ref) {
+				return true
 			}
-			p.writef(messageLevel, "%s = %s;", j.s, k.s)
-		} else if j.t == itemCommentStart {
-			p.writef(messageLevel, "// %s", j.s[2:])
 		}
-		j = p.peek()
-		if j.t == itemCommentStart {
-			p.next()
-			p.writef(0, " // %s", j.s)
-		}
-		p.parseNewline()
 	}
-	p.write(lvl, "}\n")
+	return false
 }
 
-func (p *parser) parseOneof(lvl int) {
-	i := p.next()
-	if i.t != itemOneof {
-		panic("expected oneof type")
-	}
-	p.writef(lvl, "oneof %s {", i.s)
-	p.parseNewline()
+var (
+	protoJunkRegexp  = regexp.MustCompile(`//.*|(?s:/\*.*?\*/)|"(\\.|[^"\\])*"|'(\\.|[^'\\])*'`)
+	protoTokenRegexp = regexp.MustCompile(`[A-Za-z_][\w.]*|[{};]`)
+)
 
-	messageLevel := 0
-	for {
-		j := p.peek()
-		if j.t == itemNewline {
-			p.next()
-			continue
-		}
-		if j.t != itemWhitespace {
-			break
-		}
-		if messageLevel == 0 {
-			messageLevel = len(j.s)
+// declaredTypes returns the fully qualified names of the messages and
+// enums declared in proto source
+func declaredTypes(src string) map[string]bool {
+	src = protoJunkRegexp.ReplaceAllString(src, " ")
+	tokens := protoTokenRegexp.FindAllString(src, -1)
+	decls := map[string]bool{}
+	scope := []string{}
+	name := ""
+	for i, tok := range tokens {
+		switch {
+		case tok == "package" && i+1 < len(tokens):
+			scope = append(scope, tokens[i+1])
+		case (tok == "message" || tok == "enum") && i+1 < len(tokens):
+			name = tokens[i+1]
+		case tok == "{":
+			// blocks which don't declare a type are pushed as "" so that
+			// braces stay balanced
+			scope = append(scope, name)
+			if name != "" {
+				decls[joinScope(scope)] = true
+			}
+			name = ""
+		case tok == "}" && len(scope) > 0:
+			scope = scope[:len(scope)-1]
+		case tok == ";":
+			// e.g. a field named message
+			name = ""
 		}
-		if len(j.s) < messageLevel {
-			// bug: actually okay if the next thing is a newline?
-			break
+	}
+	return decls
+}
+
+// joinScope joins the non-empty parts of a scope with dots
+func joinScope(scope []string) string {
+	parts := []string{}
+	for _, s := range scope {
+		if s != "" {
+			parts = append(parts, s)
 		}
-		p.next() // consume ws
-		p.parseField(messageLevel)
 	}
-	p.write(lvl, "}\n")
+	return strings.Join(parts, ".")
 }
@@ -0,0 +1,1220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// parser reads items from the lexer and builds a File
+type parser struct {
+	c    <-chan Item
+	head []Item
+	ctx  context.Context
+
+	line   int
+	indent int
+	syntax string
+	// blanks counts the blank lines skipped looking for the end of the
+	// blocks which just ended, which belong to the toplevel
+	blanks int
+
+	// typeMapper, if set, is tried before the builtin shorthands
+	typeMapper func(string) string
+
+	// depth is the number of messages currently being parsed
+	depth    int
+	maxDepth int
+
+	// trace, if set, receives a log of parser calls and tokens
+	trace      io.Writer
+	traceDepth int
+
+	// warnFieldCost warns about repeated and map fields with numbers
+	// which take two bytes to encode
+	warnFieldCost bool
+	// exactComments keeps comment text as written
+	exactComments bool
+	// warnEmpty warns about messages, enums and oneofs without contents
+	warnEmpty bool
+	// tabWidth is the number of columns a tab indents to
+	tabWidth int
+	// noOptional leaves out the optional label of singular scalar
+	// fields which weren't given one
+	noOptional bool
+	// requirePkg fails if the file has no package declaration
+	requirePkg bool
+	// defaultPkg is declared if the file has no package declaration
+	defaultPkg string
+
+	file *File
+}
+
+// checkPackage adds the default package to a file which didn't declare
+// one, or fails if a package is required
+func (p *parser) checkPackage() {
+	if p.file.pkg() != "" {
+		return
+	}
+	if p.defaultPkg == "" {
+		if p.requirePkg {
+			panic("parser: no package declared")
+		}
+		return
+	}
+	at := 0
+	for i, n := range p.file.Body {
+		switch n.(type) {
+		case *Syntax, *Edition:
+			at = i + 1
+		}
+	}
+	pkg := &Package{Name: p.defaultPkg}
+	p.file.Body = append(p.file.Body[:at], append(body{pkg}, p.file.Body[at:]...)...)
+}
+
+// checkEmpty warns if a block has nothing in it but comments, which is
+// often caused by its contents not being indented
+func (p *parser) checkEmpty(kind, name string, line int, b body) {
+	if !p.warnEmpty {
+		return
+	}
+	for _, n := range b {
+		if _, ok := n.(*Comment); !ok {
+			return
+		}
+	}
+	p.warnf("line %d: %s %s is empty, check the indentation of its contents", line, kind, name)
+}
+
+// warnf records a warning in the file being parsed
+func (p *parser) warnf(format string, args ...interface{}) {
+	p.file.warnings = append(p.file.warnings, fmt.Sprintf(format, args...))
+}
+
+// return the next item. what to do when channel closes?
+func (p *parser) next() Item {
+	o := Item{}
+	if len(p.head) > 0 {
+		o = p.head[0]
+		p.head = p.head[1:]
+	} else {
+		select {
+		case o = <-p.c:
+		case <-p.ctx.Done():
+			panic(p.ctx.Err())
+		}
+	}
+	p.tracef("token %s %q", o.Type, o.Value)
+	p.line = o.Line
+	if o.Type == ItemNewline {
+		p.indent = 0
+	}
+	if o.Type == ItemError {
+		panic(o.Value)
+	}
+	return o
+}
+
+// tracef writes a line to the trace, indented by the call depth
+func (p *parser) tracef(format string, args ...interface{}) {
+	if p.trace != nil {
+		fmt.Fprintf(p.trace, strings.Repeat("  ", p.traceDepth)+format+"\n", args...)
+	}
+}
+
+// enter traces a call to a parser method, returning a function which
+// traces its return, e.g. defer p.enter("parseField")()
+func (p *parser) enter(name string) func() {
+	if p.trace == nil {
+		return func() {}
+	}
+	i := p.peek()
+	p.tracef("%s: line %d indent %d next %s %q", name, i.Line, p.indent, i.Type, i.Value)
+	p.traceDepth++
+	return func() {
+		p.traceDepth--
+		p.tracef("%s done", name)
+	}
+}
+
+// peek at the next item
+func (p *parser) peek() Item {
+	return p.peekAt(0)
+}
+
+// peekAt looks n items past the next item
+func (p *parser) peekAt(n int) Item {
+	for len(p.head) <= n {
+		var i Item
+		select {
+		case i = <-p.c:
+		case <-p.ctx.Done():
+			panic(p.ctx.Err())
+		}
+		p.head = append(p.head, i)
+	}
+	if p.head[n].Type == ItemError {
+		panic(p.head[n].Value)
+	}
+	return p.head[n]
+}
+
+// block tracks the extent of a message, enum, oneof or service while
+// its contents are parsed
+type block struct {
+	name string
+	// outer is the level of the enclosing block, level the indentation
+	// of the contents of this one, set from its first line
+	outer, level int
+	// explicit blocks are opened with a colon and closed by `end`
+	// rather than by indentation
+	explicit bool
+	// inline blocks are written on one line between braces
+	inline     bool
+	endComment string
+}
+
+// openBlock starts a block after its declaration has been read. parent
+// is the block the declaration is in, or nil at the top level.
+func (p *parser) openBlock(name string, parent *block) *block {
+	b := &block{name: name}
+	if parent != nil {
+		b.outer = parent.level
+	}
+	if p.peek().Type == ItemBlockOpen {
+		b.explicit = true
+		b.inline = p.next().Value == "{"
+	}
+	return b
+}
+
+// inBlock consumes blank lines and reports whether the next line is
+// part of b, consuming its indentation if so. Comment lines don't set
+// the level, so a stray indented comment can't end the block early;
+// they are only outside the block if they are indented no further than
+// its declaration.
+func (p *parser) inBlock(b *block) (in bool) {
+	for p.peek().Type == ItemNewline {
+		p.next()
+		p.blanks++
+	}
+	defer func() { p.tracef("%s: level %d, in block %v", b.name, b.level, in) }()
+	if b.explicit {
+		if p.peek().Type == ItemWhitespace {
+			p.indent = p.column(p.next().Value)
+		}
+		switch p.peek().Type {
+		case ItemBlockEnd:
+			p.next()
+			b.endComment = p.parseLineEnd()
+			p.blanks = 0
+			return false
+		case ItemUnknown:
+			panic("parser: missing end for " + b.name)
+		case ItemCommentStart:
+		default:
+			if b.level == 0 {
+				b.level = p.indent
+			}
+		}
+		return true
+	}
+
+	j := p.peek()
+	if j.Type != ItemWhitespace {
+		return false
+	}
+	col := p.column(j.Value)
+	if col <= b.outer {
+		return false
+	}
+	switch p.peekAt(1).Type {
+	case ItemBlockEnd:
+		return false
+	case ItemCommentStart:
+	default:
+		if b.level == 0 {
+			b.level = col
+		}
+		if col < b.level {
+			// the line must line up with an enclosing block
+			if col > b.outer {
+				panic(fmt.Sprintf("line %d: indentation doesn't match %s or the block around it", j.Line, b.name))
+			}
+			return false
+		}
+		if col > b.level {
+			// still part of the block, but probably meant to be in a
+			// nested one
+			p.warnf("line %d: indented %d columns but the rest of %s is indented %d",
+				j.Line, col, b.name, b.level)
+		}
+	}
+	p.next()
+	p.indent = col
+	p.blanks = 0
+	return true
+}
+
+// column returns the width of indentation, with tabs advancing to the
+// next multiple of the tab width. Every block measures its indentation
+// this way, so blocks indented with tabs nest the same as with spaces.
+func (p *parser) column(ws string) int {
+	col := 0
+	for _, ch := range ws {
+		if ch == '\t' {
+			col += p.tabWidth - col%p.tabWidth
+		} else {
+			col++
+		}
+	}
+	return col
+}
+
+// closeBlock returns the comment for the end of a block, taking a
+// trailing comment from its body if there is no comment after `end`
+func (p *parser) closeBlock(b *block, body *body) string {
+	if b.endComment != "" {
+		return b.endComment
+	}
+	return popEndComment(body)
+}
+
+// keepBlanks adds the blank lines after a toplevel block to the file,
+// since they were read while looking for its end
+func (p *parser) keepBlanks() {
+	for ; p.blanks > 0; p.blanks-- {
+		p.file.Body = append(p.file.Body, &Blank{})
+	}
+}
+
+// toplevel parse
+func (p *parser) parse() {
+	p.file = &File{}
+	for {
+		i := p.peek()
+		switch i.Type {
+		case ItemUnknown:
+			p.checkPackage()
+			return
+		case ItemNewline:
+			p.file.Body = append(p.file.Body, &Blank{})
+			p.next()
+		case ItemWhitespace:
+			p.next()
+			if p.peek().Type == ItemCommentStart {
+				// an indented comment outside any block belongs to the
+				// next toplevel declaration
+				p.file.Body = append(p.file.Body, p.parseComment())
+				continue
+			}
+			if p.peek().Type == ItemRaw {
+				p.file.Body = append(p.file.Body, p.parseRaw())
+				continue
+			}
+			p.skipNewline()
+			p.file.Body = append(p.file.Body, &Blank{})
+		case ItemPackage:
+			p.file.Body = append(p.file.Body, &Package{Name: i.Value})
+			p.next()
+			p.parseStatementEnd()
+		case ItemSyntax:
+			if i.Value != "proto2" && i.Value != "proto3" {
+				panic("parser: unknown syntax " + i.Value)
+			}
+			if p.syntax == "editions" {
+				panic(fmt.Sprintf("line %d: a file can't declare both an edition and a syntax", i.Line))
+			}
+			p.syntax = i.Value
+			p.file.Body = append(p.file.Body, &Syntax{Value: i.Value})
+			p.next()
+			p.parseStatementEnd()
+		case ItemEdition:
+			if !editions[i.Value] {
+				panic("parser: unknown edition " + i.Value)
+			}
+			if p.syntax != "" {
+				panic(fmt.Sprintf("line %d: a file can't declare both an edition and a syntax", i.Line))
+			}
+			p.syntax = "editions"
+			p.file.Body = append(p.file.Body, &Edition{Value: i.Value})
+			p.next()
+			p.parseStatementEnd()
+		case ItemImport, ItemImportModifier:
+			imp := &Import{}
+			if i.Type == ItemImportModifier {
+				imp.Modifier = i.Value
+				p.next()
+			}
+			imp.Path = strings.Trim(p.next().Value, `"`)
+			p.file.Body = append(p.file.Body, imp)
+			imp.Comment = p.parseLineEnd()
+		case ItemOption:
+			p.file.Body = append(p.file.Body, p.parseOption())
+		case ItemEnum:
+			p.file.Body = append(p.file.Body, p.parseEnum(nil))
+			p.keepBlanks()
+		case ItemCommentStart:
+			p.file.Body = append(p.file.Body, p.parseComment())
+		case ItemRaw:
+			p.file.Body = append(p.file.Body, p.parseRaw())
+		case ItemMessageType:
+			p.file.Body = append(p.file.Body, p.parseMessage(nil))
+			p.keepBlanks()
+		case ItemService:
+			p.file.Body = append(p.file.Body, p.parseService())
+			p.keepBlanks()
+		case ItemBlockEnd:
+			panic(fmt.Sprintf("line %d: end without a block opened with ':'", i.Line))
+		default:
+			panic("parser: unexpected " + i.Type.String())
+		}
+	}
+}
+
+// parseStatementEnd consumes the newline ending a toplevel statement.
+// A trailing comment is left to be parsed on its own.
+func (p *parser) parseStatementEnd() {
+	if p.peek().Type == ItemNewline {
+		p.skipNewline()
+	}
+}
+
+// skipNewline consumes the end of the line without writing it
+func (p *parser) skipNewline() {
+	nl := p.next()
+	for nl.Type == ItemWhitespace {
+		nl = p.next()
+	}
+	if nl.Type != ItemNewline && nl.Type != ItemUnknown {
+		panic("parser: expected newline, got " + nl.Type.String())
+	}
+}
+
+// commentText strips the comment character and leading spaces from a
+// comment. The rest is kept as written, so that markers for other tools
+// such as `buf:lint:ignore RULE` pass through. With exactComments only
+// the comment character and one space are removed, so indentation and
+// markdown in the comment survive.
+func (p *parser) commentText(s string) string {
+	if s == "" {
+		return s
+	}
+	ch, size := utf8.DecodeRuneInString(s)
+	if p.exactComments {
+		return strings.TrimPrefix(s[size:], " ")
+	}
+	return strings.TrimLeft(s, string(ch)+" ")
+}
+
+// parseComment parses a line containing only a comment
+func (p *parser) parseComment() *Comment {
+	defer p.enter("parseComment")()
+	c := p.next()
+	if c.Type != ItemCommentStart {
+		panic("parser: expected comment, got " + c.Type.String())
+	}
+	p.skipNewline()
+	return &Comment{Text: p.commentText(c.Value)}
+}
+
+// parseRaw parses a raw block, removing the indentation its lines share
+func (p *parser) parseRaw() *Raw {
+	defer p.enter("parseRaw")()
+	r := p.next()
+	if r.Type != ItemRaw {
+		panic("parser: expected raw block, got " + r.Type.String())
+	}
+	p.skipNewline()
+	lines := strings.Split(r.Value, "\n")
+	prefix := ""
+	first := true
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		if first {
+			prefix, first = indent, false
+		}
+		for !strings.HasPrefix(indent, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	for i, line := range lines {
+		lines[i] = strings.TrimPrefix(line, prefix)
+	}
+	return &Raw{Text: strings.Join(lines, "\n")}
+}
+
+func (p *parser) parseMessage(parent *block) *Message {
+	defer p.enter("parseMessage")()
+	i := p.next()
+	if i.Type != ItemMessageType {
+		panic("expected message type")
+	}
+	m := &Message{Name: i.Value, line: i.Line}
+	b := p.openBlock("message "+m.Name, parent)
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > p.maxDepth {
+		panic(fmt.Sprintf("parser: message %s is nested more than %d deep", m.Name, p.maxDepth))
+	}
+	if !b.inline {
+		m.Comment = p.parseLineEnd()
+	}
+	for p.inBlock(b) {
+		// something indented, either a field or enum or oneof or message
+		if n := p.parseMessageInner(b); n != nil {
+			m.Body = append(m.Body, n)
+		}
+	}
+	m.EndComment = p.closeBlock(b, &m.Body)
+	if b.inline {
+		// the comment after the closing brace is for the whole message
+		m.Comment, m.EndComment = m.EndComment, ""
+	}
+	p.checkEmpty("message", m.Name, m.line, m.Body)
+	return m
+}
+
+// toProtoType expands a shorthand type name. A non-empty result from
+// the type mapper takes precedence over the builtin shorthands.
+func (p *parser) toProtoType(t string) string {
+	if p.typeMapper != nil {
+		if m := p.typeMapper(t); m != "" {
+			return m
+		}
+	}
+	switch t {
+	case "str":
+		return "string"
+	case "i32":
+		return "int32"
+	case "i64":
+		return "int64"
+	case "u32":
+		return "uint32"
+	case "u64":
+		return "uint64"
+	case "s32":
+		return "sint32"
+	case "s64":
+		return "sint64"
+	case "fx32":
+		return "fixed32"
+	case "fx64":
+		return "fixed64"
+	case "sfx32":
+		return "sfixed32"
+	case "sfx64":
+		return "sfixed64"
+	case "any":
+		return "google.protobuf.Any"
+	case "struct":
+		return "google.protobuf.Struct"
+	case "value":
+		return "google.protobuf.Value"
+	case "empty":
+		return "google.protobuf.Empty"
+	}
+	return t
+}
+
+// mapKeyTypes are the types which can be used as map keys
+var mapKeyTypes = map[string]bool{
+	"int32": true, "int64": true, "uint32": true, "uint64": true,
+	"sint32": true, "sint64": true, "fixed32": true, "fixed64": true,
+	"sfixed32": true, "sfixed64": true, "bool": true, "string": true,
+}
+
+// convertType converts a field type to its proto equivalent, returning
+// the label and the type. The label is inferred from the type unless an
+// explicit label is given.
+func (p *parser) convertType(s, label string) (string, string) {
+	checkArrayType(s)
+	if strings.HasPrefix(s, "map[") {
+		if label != "" {
+			panic("parser: map fields cannot have a label")
+		}
+		i := strings.Index(s, "]")
+		key := p.toProtoType(strings.TrimSpace(s[4:i]))
+		// the value is converted like a field type so that []byte
+		// becomes bytes
+		valueLabel, value := p.convertType(strings.TrimSpace(s[i+1:]), "")
+		switch {
+		case valueLabel == "repeated":
+			panic("parser: map values cannot be repeated, wrap []" + value + " in a message instead")
+		case strings.HasPrefix(value, "map<"):
+			panic("parser: map values cannot be maps, wrap " + value + " in a message instead")
+		}
+		if !mapKeyTypes[key] {
+			panic("parser: map key type " + key + " must be an integer, bool or string")
+		}
+		return "", fmt.Sprintf("map<%s, %s>", key, value)
+	}
+
+	// []byte is the go spelling of bytes, not a repeated field
+	if strings.HasPrefix(s, "[]") && strings.TrimSpace(s[2:]) == "byte" {
+		s = "bytes"
+	}
+
+	o := "optional"
+	if strings.HasPrefix(s, "[]") {
+		o = "repeated"
+		s = p.toProtoType(strings.TrimSpace(s[2:]))
+	} else {
+		s = p.toProtoType(s)
+	}
+	switch {
+	case label == "":
+		if o == "optional" && p.noOptional && p.syntax != "proto3" && scalarTypes[s] {
+			o = ""
+		}
+	case o == "repeated" && label != "repeated":
+		panic("parser: " + label + " conflicts with repeated type []" + s)
+	default:
+		o = label
+	}
+	return o, s
+}
+
+var arrayTypeRegexp = regexp.MustCompile(`^\[\s*[0-9]+\s*\]\s*`)
+
+// checkArrayType panics if s is a fixed size array type like [5]int32,
+// since protobuf only has repeated fields
+func checkArrayType(s string) {
+	if loc := arrayTypeRegexp.FindStringIndex(s); loc != nil {
+		panic(fmt.Sprintf("parser: fixed size array type %s is not supported, use a repeated field []%s instead", s, s[loc[1]:]))
+	}
+}
+
+func (p *parser) parseMessageInner(b *block) node {
+	defer p.enter("parseMessageInner")()
+	i := p.peek()
+	switch i.Type {
+	case ItemCommentStart:
+		return p.parseComment()
+	case ItemRaw:
+		return p.parseRaw()
+	case ItemIdentifier: // IDENT FIELDTYPE FIELDNUM
+		return p.parseField()
+	case ItemDeleted:
+		// reserve the number of a deleted field so it isn't reused
+		p.next()
+		f := p.parseField()
+		return &Reserved{Ranges: []*Range{{Start: f.Number, End: f.Number}}, Comment: f.Comment, line: f.line}
+	case ItemEnum:
+		return p.parseEnum(b)
+	case ItemMessageType:
+		return p.parseMessage(b)
+	case ItemOneof:
+		return p.parseOneof(b)
+	case ItemReserved:
+		return p.parseReserved()
+	case ItemExtensions:
+		return p.parseExtensions()
+	case ItemOption:
+		return p.parseOption()
+	case ItemNewline:
+		return nil
+	default:
+		panic("parser: unknown message contents" + i.Type.String())
+	}
+}
+
+func (p *parser) parseField() *Field {
+	defer p.enter("parseField")()
+	ident := p.next() // consume the peeked token
+	if ident.Type != ItemIdentifier {
+		panic("expected identifier")
+	}
+	if strings.Contains(ident.Value, ",") {
+		panic(fmt.Sprintf("line %d: fields cannot share a declaration: %s", ident.Line, ident.Value))
+	}
+	fieldType := p.next()
+	if fieldType.Type != ItemFieldType {
+		panic(fmt.Sprintf("line %d: field %q is missing a type, expected a type but got %s",
+			ident.Line, ident.Value, fieldType.Type))
+	}
+	fieldNum := p.next()
+	if fieldNum.Type != ItemFieldNum {
+		panic(fmt.Sprintf("line %d: field %q is missing a field number", ident.Line, ident.Value))
+	}
+	f := &Field{Name: ident.Value, Number: parseNumber(fieldNum.Value, fieldNum.Line), line: ident.Line}
+
+	// parse remainder of line: a label and options in any order, then
+	// an optional comment
+	for done := false; !done; {
+		if p.peek().Type == ItemBlockEnd {
+			// the closing brace of an inline message
+			break
+		}
+		rem := p.next()
+		switch rem.Type {
+		case ItemFieldLabel:
+			if f.Label != "" {
+				panic("parser: field " + f.Name + " has more than one label")
+			}
+			f.Label = p.parseLabel(rem.Value)
+		case ItemFieldOption:
+			f.Options = append(f.Options, parseFieldOptions(rem.Value)...)
+		case ItemCommentStart:
+			f.Comment = p.commentText(rem.Value)
+			p.skipNewline()
+			done = true
+		case ItemNewline, ItemUnknown:
+			done = true
+		default:
+			panic("parser: unexpected " + rem.Type.String() + " after field " + f.Name)
+		}
+	}
+	f.inferred = f.Label == ""
+	f.Label, f.Type = p.convertType(fieldType.Value, f.Label)
+	if p.syntax == "proto3" && f.inferred && f.Label == "optional" {
+		// singular fields have no label in proto3 unless explicitly optional
+		f.Label = ""
+	}
+	if p.syntax == "editions" {
+		editionPresence(f)
+	}
+	if p.warnFieldCost && f.Number > 15 {
+		// map entries are repeated on the wire too
+		switch {
+		case f.Label == "repeated":
+			p.warnf("line %d: repeated field %s has number %d, numbers above 15 take an extra byte to encode", f.line, f.Name, f.Number)
+		case strings.HasPrefix(f.Type, "map<"):
+			p.warnf("line %d: map field %s has number %d, numbers above 15 take an extra byte to encode", f.line, f.Name, f.Number)
+		}
+	}
+	normalizeDefault(f)
+	return f
+}
+
+// editions are the editions which can be declared
+var editions = map[string]bool{"2023": true}
+
+// fieldPresence is the field_presence feature set by each label in
+// editions, where presence is a feature rather than a label
+var fieldPresence = map[string]string{
+	"optional": "EXPLICIT",
+	"implicit": "IMPLICIT",
+	"required": "LEGACY_REQUIRED",
+}
+
+// editionPresence replaces the label of a field in an editions file with
+// the field_presence feature it stands for. Singular fields without a
+// label get the edition's default presence.
+func editionPresence(f *Field) {
+	if f.inferred {
+		if f.Label == "optional" {
+			f.Label = ""
+		}
+		return
+	}
+	if presence, ok := fieldPresence[f.Label]; ok {
+		f.Label = ""
+		f.Options = append(f.Options, &FieldOption{Name: "features.field_presence", Value: presence})
+	}
+}
+
+// popEndComment removes the comment lines at the very end of a block
+// body and returns them, so they can be written after the closing brace
+func popEndComment(b *body) string {
+	lines := []string{}
+	for len(*b) > 0 {
+		c, ok := (*b)[len(*b)-1].(*Comment)
+		if !ok || isDirective(c.Text) {
+			break
+		}
+		lines = append([]string{c.Text}, lines...)
+		*b = (*b)[:len(*b)-1]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parseReserved parses RESERVED (COMMENT) NEWLINE. Reserved fields are
+// either all numbers or all names.
+func (p *parser) parseReserved() *Reserved {
+	defer p.enter("parseReserved")()
+	i := p.next()
+	r := &Reserved{line: i.Line}
+	for _, s := range splitOutsideQuotes(i.Value, ',') {
+		s = strings.TrimSpace(s)
+		if strings.HasPrefix(s, `"`) {
+			name, err := strconv.Unquote(s)
+			if err != nil {
+				panic(fmt.Sprintf("line %d: invalid reserved name %s", i.Line, s))
+			}
+			r.Names = append(r.Names, name)
+		} else {
+			r.Ranges = append(r.Ranges, parseRange(s, i.Line))
+		}
+	}
+	if len(r.Names) > 0 && len(r.Ranges) > 0 {
+		panic(fmt.Sprintf("line %d: reserved cannot mix numbers and names", i.Line))
+	}
+	r.Comment = p.parseLineEnd()
+	return r
+}
+
+// parseOption parses OPTION VALUE (COMMENT) NEWLINE, in a file or a
+// block
+func (p *parser) parseOption() *Option {
+	defer p.enter("parseOption")()
+	i := p.next()
+	j := p.peek()
+	if j.Type != ItemOptionName && j.Type != ItemNumber {
+		panic("parser: expected option value")
+	}
+	p.next()
+	return &Option{Name: i.Value, Value: j.Value, Comment: p.parseLineEnd()}
+}
+
+// parseExtensions parses EXTENSIONS (COMMENT) NEWLINE
+func (p *parser) parseExtensions() *Extensions {
+	defer p.enter("parseExtensions")()
+	i := p.next()
+	e := &Extensions{}
+	for _, s := range strings.Split(i.Value, ",") {
+		e.Ranges = append(e.Ranges, parseRange(strings.TrimSpace(s), i.Line))
+	}
+	e.Comment = p.parseLineEnd()
+	return e
+}
+
+// parseRange parses a number or a range such as `9 to 11` or `100 to max`
+// on the given line
+func parseRange(s string, line int) *Range {
+	parts := strings.Fields(s)
+	switch {
+	case len(parts) == 1:
+		n := parseNumber(parts[0], line)
+		return &Range{Start: n, End: n}
+	case len(parts) == 3 && parts[1] == "to":
+		r := &Range{Start: parseNumber(parts[0], line)}
+		if parts[2] == "max" {
+			r.Max = true
+		} else {
+			r.End = parseNumber(parts[2], line)
+		}
+		return r
+	}
+	panic(fmt.Sprintf("line %d: invalid range %q", line, s))
+}
+
+// parseLineEnd parses an optional trailing comment and the newline,
+// returning the comment text
+func (p *parser) parseLineEnd() string {
+	comment := ""
+	if p.peek().Type == ItemCommentStart {
+		comment = p.commentText(p.next().Value)
+	}
+	p.skipNewline()
+	return comment
+}
+
+// parseFieldOptions parses the contents of a field's option list. Empty
+// entries, e.g. from a trailing comma, are dropped and an option without
+// a value is set to true.
+func parseFieldOptions(s string) []*FieldOption {
+	opts := []*FieldOption{}
+	for _, o := range splitOutsideQuotes(s, ',') {
+		o = strings.TrimSpace(o)
+		if o == "" {
+			continue
+		}
+		kv := splitOutsideQuotes(o, '=')
+		opt := &FieldOption{Name: strings.TrimSpace(kv[0]), Value: "true"}
+		if len(kv) > 1 {
+			opt.Value = strings.TrimSpace(strings.Join(kv[1:], "="))
+		}
+		if opt.Name == "" {
+			panic("parser: missing option name in " + strconv.Quote(s))
+		}
+		if values, ok := optionEnums[opt.Name]; ok {
+			opts = append(opts, enumOptions(opt, values)...)
+			continue
+		}
+		opts = append(opts, opt)
+	}
+	return opts
+}
+
+// optionEnums are the options which take values of an enum, and the
+// values they can take
+var optionEnums = map[string][]string{
+	"retention": {"RETENTION_UNKNOWN", "RETENTION_RUNTIME", "RETENTION_SOURCE"},
+	"targets": {
+		"TARGET_TYPE_UNKNOWN", "TARGET_TYPE_FILE", "TARGET_TYPE_EXTENSION_RANGE",
+		"TARGET_TYPE_MESSAGE", "TARGET_TYPE_FIELD", "TARGET_TYPE_ONEOF",
+		"TARGET_TYPE_ENUM", "TARGET_TYPE_ENUM_ENTRY", "TARGET_TYPE_SERVICE",
+		"TARGET_TYPE_METHOD",
+	},
+}
+
+// enumOptions checks the value of an option which takes enum values. A
+// list in brackets, e.g. `targets = [TARGET_TYPE_FIELD, TARGET_TYPE_ONEOF]`,
+// is split into an option per value since only repeated options can
+// take several values.
+func enumOptions(opt *FieldOption, values []string) []*FieldOption {
+	list := []string{opt.Value}
+	if strings.HasPrefix(opt.Value, "[") && strings.HasSuffix(opt.Value, "]") {
+		if opt.Name != "targets" {
+			panic(fmt.Sprintf("parser: option %s takes a single value, not %s", opt.Name, opt.Value))
+		}
+		list = strings.Split(opt.Value[1:len(opt.Value)-1], ",")
+	}
+	opts := []*FieldOption{}
+	for _, v := range list {
+		v = strings.TrimSpace(v)
+		valid := false
+		for _, value := range values {
+			valid = valid || v == value
+		}
+		if !valid {
+			panic(fmt.Sprintf("parser: invalid %s %q, must be one of %s", opt.Name, v, strings.Join(values, ", ")))
+		}
+		opts = append(opts, &FieldOption{Name: opt.Name, Value: v})
+	}
+	return opts
+}
+
+// normalizeDefault checks the default value of a bytes field is a string
+// and escapes it consistently
+func normalizeDefault(f *Field) {
+	if f.Type != "bytes" {
+		return
+	}
+	for _, o := range f.Options {
+		if o.Name != "default" {
+			continue
+		}
+		b, err := unquoteProto(o.Value)
+		if err != nil {
+			panic(fmt.Sprintf("parser: invalid default for bytes field %s: %v", f.Name, err))
+		}
+		o.Value = quoteBytes(b)
+	}
+}
+
+// splitOutsideQuotes splits s around sep, ignoring any sep inside quotes
+// or brackets
+func splitOutsideQuotes(s string, sep rune) []string {
+	parts := []string{}
+	depth := 0
+	quote := rune(0)
+	escaped := false
+	start := 0
+	for i, ch := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case quote != 0:
+			if ch == '\\' {
+				escaped = true
+			} else if ch == quote {
+				quote = 0
+			}
+		case ch == '"' || ch == '\'':
+			quote = ch
+		case ch == '[' || ch == '{':
+			depth++
+		case ch == ']' || ch == '}':
+			depth--
+		case ch == sep && depth == 0:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseNumber parses a field or enum value number, which may be hex
+// (0x1f) or octal (017), on the given line
+func parseNumber(s string, line int) int {
+	digits, base := s, 10
+	switch {
+	case strings.HasPrefix(s, "0x"), strings.HasPrefix(s, "0X"):
+		digits, base = s[2:], 16
+	case len(s) > 1 && s[0] == '0':
+		digits, base = s[1:], 8
+	}
+	n, err := strconv.ParseInt(digits, base, 0)
+	if err != nil {
+		panic(fmt.Sprintf("line %d: invalid number %q", line, s))
+	}
+	return int(n)
+}
+
+// parseLabel validates an explicit field label
+func (p *parser) parseLabel(label string) string {
+	switch label {
+	case "optional", "repeated":
+	case "required":
+		if p.syntax == "proto3" {
+			panic("parser: required fields are not allowed in proto3")
+		}
+	case "implicit":
+		if p.syntax != "editions" {
+			panic("parser: implicit is only a label in editions")
+		}
+	default:
+		panic("parser: unknown field label " + label)
+	}
+	return label
+}
+
+func (p *parser) parseEnum(parent *block) *Enum {
+	defer p.enter("parseEnum")()
+	i := p.next()
+	if i.Type != ItemEnum {
+		panic("expected enum type")
+	}
+	e := &Enum{Name: i.Value, line: i.Line}
+	b := p.openBlock("enum "+e.Name, parent)
+	e.Comment = p.parseLineEnd()
+
+	// expect WS IDENT FIELDNUM? (COMMENT) NEWLINE
+	// expect WS COMMENT NEWLINE
+	// expect WS NEWLINE
+	// values without a number are numbered from the previous value.
+	// A list of names declares aliases sharing one number.
+	numbers := map[int]*EnumValue{}
+	auto := map[*EnumValue]bool{}
+	next := 0
+	alias := false
+	for p.inBlock(b) {
+		if p.peek().Type == ItemCommentStart {
+			// a comment on its own line, no value follows
+			e.Body = append(e.Body, p.parseComment())
+			continue
+		}
+		if p.peek().Type == ItemRaw {
+			e.Body = append(e.Body, p.parseRaw())
+			continue
+		}
+		if p.peek().Type == ItemReserved {
+			e.Body = append(e.Body, p.parseReserved())
+			continue
+		}
+		j := p.next()
+		switch j.Type {
+		case ItemIdentifier:
+			number, isAuto := next, true
+			if p.peek().Type == ItemFieldNum {
+				num := p.next()
+				number, isAuto = parseNumber(num.Value, num.Line), false
+			}
+			names := map[*EnumValue]bool{}
+			for _, name := range strings.Split(j.Value, ",") {
+				v := &EnumValue{Name: name, Number: number, line: j.Line}
+				auto[v] = isAuto
+				if prev, ok := numbers[v.Number]; ok {
+					if (auto[v] || auto[prev]) && !names[prev] {
+						panic(fmt.Sprintf("parser: enum %s: automatic numbering gives %s and %s the same number %d",
+							e.Name, prev.Name, v.Name, v.Number))
+					}
+					if !names[prev] {
+						// only values listed together are aliases
+						panic(fmt.Sprintf("parser: enum %s: %s uses number %d, already used by %s on line %d",
+							e.Name, v.Name, v.Number, prev.Name, prev.line))
+					}
+					alias = true
+				}
+				numbers[v.Number] = v
+				names[v] = true
+				e.Body = append(e.Body, v)
+			}
+			next = number + 1
+		default:
+			panic("parser: unknown enum contents " + j.Type.String())
+		}
+		j = p.peek()
+		if j.Type == ItemCommentStart {
+			p.next()
+			v := e.Body[len(e.Body)-1].(*EnumValue)
+			v.Comment = p.commentText(j.Value)
+		}
+		p.skipNewline()
+	}
+	e.EndComment = p.closeBlock(b, &e.Body)
+	p.checkEmpty("enum", e.Name, e.line, e.Body)
+	if alias {
+		e.Body = append(body{&Option{Name: "allow_alias", Value: "true", auto: true}}, e.Body...)
+	}
+	return e
+}
+
+func (p *parser) parseOneof(parent *block) *Oneof {
+	defer p.enter("parseOneof")()
+	i := p.next()
+	if i.Type != ItemOneof {
+		panic("expected oneof type")
+	}
+	o := &Oneof{Name: i.Value, line: i.Line}
+	b := p.openBlock("oneof "+o.Name, parent)
+	o.Comment = p.parseLineEnd()
+
+	for p.inBlock(b) {
+		if p.peek().Type == ItemCommentStart {
+			// a comment on its own line, usually for the next field
+			o.Body = append(o.Body, p.parseComment())
+			continue
+		}
+		if p.peek().Type == ItemOption {
+			o.Body = append(o.Body, p.parseOption())
+			continue
+		}
+		if p.peek().Type == ItemRaw {
+			o.Body = append(o.Body, p.parseRaw())
+			continue
+		}
+		if j := p.peek(); j.Type == ItemDeleted {
+			// reserved is only allowed in the message
+			panic(fmt.Sprintf("line %d: oneof %s: a deleted field can't be in a oneof, "+
+				"move it to the message to reserve its number", j.Line, o.Name))
+		}
+		f := p.parseField()
+		switch {
+		case strings.HasPrefix(f.Type, "map<"):
+			panic(fmt.Sprintf("line %d: oneof %s: field %s cannot be a map, protobuf doesn't allow "+
+				"maps in a oneof; wrap the map in a message of its own and use that message in the oneof",
+				f.line, o.Name, f.Name))
+		case f.Label == "optional":
+			// oneof fields must not have a label
+			f.Label = ""
+		case f.Label != "":
+			panic(fmt.Sprintf("line %d: oneof %s: field %s cannot be %s", f.line, o.Name, f.Name, f.Label))
+		}
+		o.Body = append(o.Body, f)
+	}
+	o.EndComment = p.closeBlock(b, &o.Body)
+	p.checkEmpty("oneof", o.Name, o.line, o.Body)
+	return o
+}
+
+func (p *parser) parseService() *Service {
+	defer p.enter("parseService")()
+	i := p.next()
+	if i.Type != ItemService {
+		panic("expected service type")
+	}
+	svc := &Service{Name: i.Value, line: i.Line}
+	b := p.openBlock("service "+svc.Name, nil)
+	svc.Comment = p.parseLineEnd()
+
+	for p.inBlock(b) {
+		if p.peek().Type == ItemCommentStart {
+			svc.Body = append(svc.Body, p.parseComment())
+			continue
+		}
+		if p.peek().Type == ItemRaw {
+			svc.Body = append(svc.Body, p.parseRaw())
+			continue
+		}
+		svc.Body = append(svc.Body, p.parseRPC())
+	}
+	svc.EndComment = p.closeBlock(b, &svc.Body)
+	return svc
+}
+
+// parseRPC parses RPC STREAM? FIELDTYPE STREAM? FIELDTYPE (COMMENT) NEWLINE
+func (p *parser) parseRPC() *RPC {
+	defer p.enter("parseRPC")()
+	i := p.next()
+	if i.Type != ItemRPC {
+		panic("parser: expected rpc but got " + i.Type.String())
+	}
+	r := &RPC{Name: i.Value, line: i.Line}
+	r.Request, r.RequestStream = p.parseRPCType()
+	r.Response, r.ResponseStream = p.parseRPCType()
+	if p.peek().Type == ItemCommentStart {
+		r.Comment = p.commentText(p.next().Value)
+	}
+	p.skipNewline()
+	return r
+}
+
+// parseRPCType parses the request or response type of an rpc
+func (p *parser) parseRPCType() (string, bool) {
+	i := p.next()
+	stream := i.Type == ItemStream
+	if stream {
+		i = p.next()
+	}
+	if i.Type != ItemFieldType || i.Value == "" {
+		panic("parser: expected rpc type but got " + i.Type.String())
+	}
+	return p.toProtoType(i.Value), stream
+}
+
+// wellKnownTypes maps well known types to the file they are defined in
+var wellKnownTypes = map[string]string{
+	"google.protobuf.Any":    "google/protobuf/any.proto",
+	"google.protobuf.Struct": "google/protobuf/struct.proto",
+	"google.protobuf.Value":  "google/protobuf/struct.proto",
+	"google.protobuf.Empty":  "google/protobuf/empty.proto",
+}
+
+// addWellKnownImports adds imports for any well known types used in the
+// file which are not already imported
+func addWellKnownImports(f *File) {
+	imported := map[string]bool{}
+	for _, imp := range f.imports() {
+		imported[imp] = true
+	}
+	missing := []node{}
+	for _, t := range f.typeRefs() {
+		path, ok := wellKnownTypes[t]
+		if ok && !imported[path] {
+			imported[path] = true
+			missing = append(missing, &Import{Path: path, auto: true})
+		}
+	}
+	if len(missing) == 0 {
+		return
+	}
+
+	// insert after the last import, or the package or syntax statement
+	at := 0
+	for i, n := range f.Body {
+		switch n.(type) {
+		case *Syntax, *Edition, *Package, *Import:
+			at = i + 1
+		}
+	}
+	f.Body = append(f.Body[:at], append(missing, f.Body[at:]...)...)
+}
+
+// addGoPackage adds a go_package option made from base and the file's
+// package, unless the file already sets go_package
+func addGoPackage(f *File, base string) {
+	pkg := ""
+	at := 0
+	for i, n := range f.Body {
+		switch n := n.(type) {
+		case *Option:
+			if n.Name == "go_package" {
+				return
+			}
+			at = i + 1
+		case *Package:
+			pkg = n.Name
+			at = i + 1
+		case *Syntax, *Edition, *Import:
+			at = i + 1
+		}
+	}
+	path := strings.TrimSuffix(base, "/")
+	if pkg != "" {
+		path += "/" + strings.ReplaceAll(pkg, ".", "/")
+	}
+	opt := &Option{Name: "go_package", Value: strconv.Quote(path)}
+	f.Body = append(f.Body[:at], append(body{opt}, f.Body[at:]...)...)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// scalarTypes are the builtin proto types, which never need resolving
+var scalarTypes = map[string]bool{
+	"double": true, "float": true, "bool": true, "string": true, "bytes": true,
+	"int32": true, "int64": true, "uint32": true, "uint64": true,
+	"sint32": true, "sint64": true, "fixed32": true, "fixed64": true,
+	"sfixed32": true, "sfixed64": true,
+}
+
+// symbols returns the kind, message or enum, of each type declared in
+// f including nested ones, keyed by fully qualified name
+func symbols(f *File) map[string]string {
+	syms := map[string]string{}
+	var collect func(scope string, b body)
+	collect = func(scope string, b body) {
+		for _, n := range b {
+			switch n := n.(type) {
+			case *Message:
+				syms[scopedName(scope, n.Name)] = n.kind()
+				collect(scopedName(scope, n.Name), n.Body)
+			case *Enum:
+				syms[scopedName(scope, n.Name)] = n.kind()
+			}
+		}
+	}
+	collect(f.pkg(), f.Body)
+	return syms
+}
+
+// unknownTypes returns a warning for each field or rpc type in f which
+// isn't a scalar, declared in f or declared in one of imported, which
+// holds the fully qualified names of imported types
+func unknownTypes(f *File, imported map[string]bool) []string {
+	syms := symbols(f)
+	for t := range imported {
+		syms[t] = ""
+	}
+	for t := range wellKnownTypes {
+		syms[t] = "message"
+	}
+	warnings := []string{}
+	check := func(scope, t string, line int, what string) {
+		if _, ok := resolveType(syms, scope, t); ok || scalarTypes[t] {
+			return
+		}
+		warnings = append(warnings, fmt.Sprintf("line %d: unknown type %s in %s", line, t, what))
+	}
+	var walkScope func(scope string, b body)
+	walkScope = func(scope string, b body) {
+		for _, n := range b {
+			switch n := n.(type) {
+			case *Message:
+				walkScope(scopedName(scope, n.Name), n.Body)
+			case *Oneof:
+				walkScope(scope, n.Body)
+			case *Service:
+				walkScope(scope, n.Body)
+			case *Field:
+				t := n.Type
+				if strings.HasPrefix(t, "map<") {
+					t = strings.TrimSpace(t[strings.Index(t, ",")+1 : len(t)-1])
+				}
+				check(scope, t, n.line, "field "+n.Name)
+			case *RPC:
+				check(scope, n.Request, n.line, "rpc "+n.Name)
+				check(scope, n.Response, n.line, "rpc "+n.Name)
+			}
+		}
+	}
+	walkScope(f.pkg(), f.Body)
+	return warnings
+}
+
+// resolveType looks t up the way protoc does, starting in scope and
+// moving outwards, and returns its fully qualified name. A leading dot
+// means t is already fully qualified.
+func resolveType(syms map[string]string, scope, t string) (string, bool) {
+	if strings.HasPrefix(t, ".") {
+		_, ok := syms[t[1:]]
+		return t[1:], ok
+	}
+	for {
+		name := scopedName(scope, t)
+		if _, ok := syms[name]; ok {
+			return name, true
+		}
+		if scope == "" {
+			return "", false
+		}
+		i := strings.LastIndex(scope, ".")
+		if i < 0 {
+			scope = ""
+		} else {
+			scope = scope[:i]
+		}
+	}
+}
+
+// scopedName returns name qualified by scope, if there is one
+func scopedName(scope, name string) string {
+	if scope == "" {
+		return name
+	}
+	return scope + "." + name
+}
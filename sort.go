@@ -0,0 +1,74 @@
+package main
+
+import (
+	"sort"
+)
+
+// sortFields sorts the fields of every message by number. A oneof is
+// kept together and sorted by its lowest field number. Comment lines
+// move with the declaration that follows them, and other declarations
+// such as nested messages keep their place.
+func sortFields(f *File) {
+	walk(f.Body, func(n node) {
+		if m, ok := n.(*Message); ok {
+			m.Body = sortBody(m.Body)
+		}
+	})
+}
+
+// unit is a declaration together with the comment lines before it
+type unit struct {
+	nodes  body
+	number int
+	sorted bool
+}
+
+func sortBody(b body) body {
+	units := []*unit{}
+	cur := &unit{}
+	for _, n := range b {
+		cur.nodes = append(cur.nodes, n)
+		switch n := n.(type) {
+		case *Comment:
+			continue
+		case *Field:
+			cur.number, cur.sorted = n.Number, true
+		case *Oneof:
+			cur.number, cur.sorted = oneofNumber(n), true
+		}
+		units = append(units, cur)
+		cur = &unit{}
+	}
+
+	sortable := []*unit{}
+	for _, u := range units {
+		if u.sorted {
+			sortable = append(sortable, u)
+		}
+	}
+	sort.SliceStable(sortable, func(i, j int) bool {
+		return sortable[i].number < sortable[j].number
+	})
+
+	// put the sorted units back in the slots fields and oneofs came from
+	out := body{}
+	for _, u := range units {
+		if u.sorted {
+			u, sortable = sortable[0], sortable[1:]
+		}
+		out = append(out, u.nodes...)
+	}
+	// trailing comments which don't precede anything stay at the end
+	return append(out, cur.nodes...)
+}
+
+// oneofNumber returns the lowest field number in the oneof
+func oneofNumber(o *Oneof) int {
+	min := -1
+	for _, n := range o.Body {
+		if f, ok := n.(*Field); ok && (min < 0 || f.Number < min) {
+			min = f.Number
+		}
+	}
+	return min
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// splitDecl is a toplevel declaration split into a file of its own
+type splitDecl struct {
+	path string
+	file *File
+}
+
+// splitFile splits each toplevel message, enum and service of f into a
+// file named <package path>/<Name>.proto. Each file gets the syntax,
+// package and options of f, the imports it uses and imports of the
+// other split files it refers to. Comments directly before a
+// declaration go with it.
+func splitFile(f *File, protoPaths []string) []*splitDecl {
+	header := body{}
+	pkg := ""
+	for _, n := range f.Body {
+		switch n := n.(type) {
+		case *Package:
+			pkg = n.Name
+			header = append(header, n)
+		case *Syntax, *Edition, *Option:
+			header = append(header, n)
+		}
+	}
+	dir := strings.ReplaceAll(pkg, ".", "/")
+
+	// find the file each declaration goes in first, so that references
+	// between them can be imported
+	paths := map[string]string{}
+	for _, n := range f.Body {
+		if name := blockName(n); name != "" {
+			paths[name] = path.Join(dir, name+".proto")
+		}
+	}
+
+	out := []*splitDecl{}
+	comments := body{}
+	for _, n := range f.Body {
+		switch n.(type) {
+		case *Comment:
+			comments = append(comments, n)
+			continue
+		case *Message, *Enum, *Service:
+		default:
+			comments = body{}
+			continue
+		}
+		name := blockName(n)
+		decl := append(comments, n)
+		comments = body{}
+
+		refs := (&File{Body: decl}).typeRefs()
+		imports := body{}
+		for _, n := range f.Body {
+			// the import itself is kept so its modifier and comment are too
+			imp, ok := n.(*Import)
+			if !ok {
+				continue
+			}
+			decls := importDecls(imp.Path, protoPaths)
+			if len(decls) == 0 || usesDecls(refs, decls) {
+				imports = append(imports, imp)
+			}
+		}
+		imported := map[string]bool{}
+		for _, ref := range refs {
+			ref = strings.TrimPrefix(strings.TrimPrefix(ref, "."), pkg+".")
+			other := strings.SplitN(ref, ".", 2)[0]
+			p, ok := paths[other]
+			if ok && other != name && !imported[p] {
+				imported[p] = true
+				imports = append(imports, &Import{Path: p})
+			}
+		}
+
+		b := append(body{}, header...)
+		for _, section := range []body{imports, decl} {
+			if len(b) > 0 && len(section) > 0 {
+				b = append(b, &Blank{})
+			}
+			b = append(b, section...)
+		}
+		out = append(out, &splitDecl{path: paths[name], file: &File{Body: b}})
+	}
+	return out
+}
+
+// blockName returns the name of a toplevel message, enum or service
+func blockName(n node) string {
+	switch n := n.(type) {
+	case *Message:
+		return n.Name
+	case *Enum:
+		return n.Name
+	case *Service:
+		return n.Name
+	}
+	return ""
+}
@@ -0,0 +1,81 @@
+package main
+
+// style is a set of formatting rules for the emitter
+type style struct {
+	// indent is one level of indentation
+	indent string
+	// separateBlocks puts exactly one blank line between toplevel
+	// messages, enums and services and the statements around them
+	separateBlocks bool
+	// checkNames warns about names which don't follow the naming
+	// conventions
+	checkNames bool
+}
+
+// styles are the profiles which can be chosen with -style
+var styles = map[string]*style{
+	"default": {indent: indentSpace},
+	// https://protobuf.dev/programming-guides/style/
+	"google": {indent: "  ", separateBlocks: true, checkNames: true},
+}
+
+// separateBlocks collapses runs of blank lines and adds a blank line
+// around each block. Comments directly before a block stay with it.
+func separateBlocks(b body) body {
+	out := body{}
+	for i, n := range b {
+		_, blank := n.(*Blank)
+		if len(out) == 0 {
+			if !blank {
+				out = append(out, n)
+			}
+			continue
+		}
+		prev := out[len(out)-1]
+		if _, ok := prev.(*Blank); ok {
+			if !blank {
+				out = append(out, n)
+			}
+			continue
+		}
+		if blank {
+			out = append(out, n)
+			continue
+		}
+		_, prevComment := prev.(*Comment)
+		if isBlock(prev) || (!prevComment && startsBlock(b[i:])) {
+			out = append(out, &Blank{})
+		}
+		out = append(out, n)
+	}
+	return out
+}
+
+func isBlock(n node) bool {
+	switch n.(type) {
+	case *Message, *Enum, *Service:
+		return true
+	}
+	return false
+}
+
+// startsBlock returns whether b starts with a block, possibly after
+// some comments
+func startsBlock(b body) bool {
+	for _, n := range b {
+		if _, ok := n.(*Comment); !ok {
+			return isBlock(n)
+		}
+	}
+	return false
+}
+
+// styleWarnings returns a warning for each name in f which doesn't
+// follow the style guide's naming conventions
+func styleWarnings(f *File) []string {
+	warnings := []string{}
+	for _, p := range lint(f, map[string]bool{"field-number-gap": true}) {
+		warnings = append(warnings, p.String())
+	}
+	return warnings
+}
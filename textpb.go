@@ -0,0 +1,448 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// descriptorTypes maps scalar types to their FieldDescriptorProto type
+var descriptorTypes = map[string]string{
+	"double": "TYPE_DOUBLE", "float": "TYPE_FLOAT", "bool": "TYPE_BOOL",
+	"string": "TYPE_STRING", "bytes": "TYPE_BYTES",
+	"int32": "TYPE_INT32", "int64": "TYPE_INT64",
+	"uint32": "TYPE_UINT32", "uint64": "TYPE_UINT64",
+	"sint32": "TYPE_SINT32", "sint64": "TYPE_SINT64",
+	"fixed32": "TYPE_FIXED32", "fixed64": "TYPE_FIXED64",
+	"sfixed32": "TYPE_SFIXED32", "sfixed64": "TYPE_SFIXED64",
+}
+
+// fileOptionFields are the file options with a field of their own in
+// FileOptions. Other options are written as comments.
+var fileOptionFields = map[string]bool{
+	"java_package": true, "java_outer_classname": true, "java_multiple_files": true,
+	"go_package": true, "optimize_for": true, "cc_enable_arenas": true,
+	"objc_class_prefix": true, "csharp_namespace": true, "php_namespace": true,
+	"ruby_package": true, "swift_prefix": true, "deprecated": true,
+}
+
+// fieldOptionFields are the field options with a field of their own in
+// FieldOptions
+var fieldOptionFields = map[string]bool{
+	"deprecated": true, "packed": true, "lazy": true, "retention": true, "targets": true,
+}
+
+// messageOptionFields are the message options with a field of their own
+// in MessageOptions
+var messageOptionFields = map[string]bool{
+	"message_set_wire_format": true, "no_standard_descriptor_accessor": true, "deprecated": true,
+}
+
+// maxFieldNumber is the largest field number, which `max` stands for
+const maxFieldNumber = 536870911
+
+// maxEnumNumber is the largest enum value, which `max` stands for in an
+// enum
+const maxEnumNumber = 2147483647
+
+// descriptorWriter writes a File as a FileDescriptorProto in protobuf
+// text format, the way protoc would describe it
+type descriptorWriter struct {
+	w      io.Writer
+	lvl    int
+	syms   map[string]string
+	syntax string
+}
+
+func (d *descriptorWriter) printf(format string, args ...interface{}) {
+	fmt.Fprintf(d.w, strings.Repeat("  ", d.lvl)+format+"\n", args...)
+}
+
+func (d *descriptorWriter) open(name string) {
+	d.printf("%s {", name)
+	d.lvl++
+}
+
+func (d *descriptorWriter) close() {
+	d.lvl--
+	d.printf("}")
+}
+
+// writeDescriptor writes f as a FileDescriptorProto named name
+func writeDescriptor(w io.Writer, f *File, name string) {
+	d := &descriptorWriter{w: w, syms: symbols(f)}
+	for t := range wellKnownTypes {
+		d.syms[t] = "message"
+	}
+	pkg := f.pkg()
+	d.printf("name: %q", name)
+	if pkg != "" {
+		d.printf("package: %q", pkg)
+	}
+	deps := 0
+	for _, n := range f.Body {
+		if i, ok := n.(*Import); ok {
+			d.printf("dependency: %q", i.Path)
+			switch i.Modifier {
+			case "public":
+				d.printf("public_dependency: %d", deps)
+			case "weak":
+				d.printf("weak_dependency: %d", deps)
+			}
+			deps++
+		}
+	}
+	edition := ""
+	for _, n := range f.Body {
+		switch n := n.(type) {
+		case *Syntax:
+			d.syntax = n.Value
+		case *Edition:
+			d.syntax, edition = "editions", n.Value
+		}
+	}
+	for _, n := range f.Body {
+		switch n := n.(type) {
+		case *Message:
+			d.message("message_type", pkg, n)
+		case *Enum:
+			d.enum(n)
+		case *Service:
+			d.service(pkg, n)
+		}
+	}
+	opts := []*Option{}
+	for _, n := range f.Body {
+		if o, ok := n.(*Option); ok {
+			opts = append(opts, o)
+		}
+	}
+	d.options(opts, fileOptionFields)
+	if d.syntax != "" {
+		d.printf("syntax: %q", d.syntax)
+	}
+	if edition != "" {
+		d.printf("edition: EDITION_%s", edition)
+	}
+}
+
+// options writes an options message. Options without a field of their
+// own in it are written as comments.
+func (d *descriptorWriter) options(opts []*Option, fields map[string]bool) {
+	if len(opts) == 0 {
+		return
+	}
+	d.open("options")
+	for _, o := range opts {
+		if fields[o.Name] {
+			d.printf("%s: %s", o.Name, o.Value)
+		} else {
+			d.printf("# %s = %s", o.Name, o.Value)
+		}
+	}
+	d.close()
+}
+
+func (d *descriptorWriter) message(key, scope string, m *Message) {
+	scope = scopedName(scope, m.Name)
+	d.open(key)
+	d.printf("name: %q", m.Name)
+
+	// oneofs are numbered in order, followed by the synthetic oneofs of
+	// proto3 optional fields
+	oneofs := []string{}
+	oneofOpts := map[string][]*Option{}
+	synthetic := []string{}
+	fields := []*Field{}
+	oneofIndex := map[*Field]int{}
+	maps := []*Field{}
+	for _, n := range m.Body {
+		switch n := n.(type) {
+		case *Field:
+			fields = append(fields, n)
+			if strings.HasPrefix(n.Type, "map<") {
+				maps = append(maps, n)
+			}
+		case *Oneof:
+			for _, o := range n.Body {
+				switch o := o.(type) {
+				case *Field:
+					fields = append(fields, o)
+					oneofIndex[o] = len(oneofs)
+				case *Option:
+					oneofOpts[n.Name] = append(oneofOpts[n.Name], o)
+				}
+			}
+			oneofs = append(oneofs, n.Name)
+		}
+	}
+	for _, f := range fields {
+		if _, ok := oneofIndex[f]; !ok && d.proto3Optional(f) {
+			oneofIndex[f] = len(oneofs) + len(synthetic)
+			synthetic = append(synthetic, "_"+f.Name)
+		}
+	}
+
+	for _, f := range fields {
+		i, ok := oneofIndex[f]
+		if !ok {
+			i = -1
+		}
+		d.field(scope, f, i)
+	}
+	for _, n := range m.Body {
+		switch n := n.(type) {
+		case *Message:
+			d.message("nested_type", scope, n)
+		}
+	}
+	for _, f := range maps {
+		d.mapEntry(scope, f)
+	}
+	for _, n := range m.Body {
+		if e, ok := n.(*Enum); ok {
+			d.enum(e)
+		}
+	}
+	for _, n := range m.Body {
+		if e, ok := n.(*Extensions); ok {
+			for _, r := range e.Ranges {
+				d.printf("extension_range { start: %d end: %d }", r.Start, rangeEnd(r, maxFieldNumber)+1)
+			}
+		}
+	}
+	opts := []*Option{}
+	for _, n := range m.Body {
+		if o, ok := n.(*Option); ok {
+			opts = append(opts, o)
+		}
+	}
+	d.options(opts, messageOptionFields)
+	for _, name := range append(oneofs, synthetic...) {
+		if len(oneofOpts[name]) == 0 {
+			d.printf("oneof_decl { name: %q }", name)
+			continue
+		}
+		d.open("oneof_decl")
+		d.printf("name: %q", name)
+		d.options(oneofOpts[name], nil)
+		d.close()
+	}
+	for _, n := range m.Body {
+		if r, ok := n.(*Reserved); ok {
+			for _, rg := range r.Ranges {
+				d.printf("reserved_range { start: %d end: %d }", rg.Start, rangeEnd(rg, maxFieldNumber)+1)
+			}
+			for _, name := range r.Names {
+				d.printf("reserved_name: %q", name)
+			}
+		}
+	}
+	d.close()
+}
+
+// proto3Optional returns whether f is an explicitly optional proto3
+// field, which protoc puts in a oneof of its own
+func (d *descriptorWriter) proto3Optional(f *Field) bool {
+	return d.syntax == "proto3" && f.Label == "optional"
+}
+
+func (d *descriptorWriter) field(scope string, f *Field, oneof int) {
+	d.open("field")
+	d.printf("name: %q", f.Name)
+	d.printf("number: %d", f.Number)
+	label := "LABEL_OPTIONAL"
+	switch {
+	case f.Label == "repeated", strings.HasPrefix(f.Type, "map<"):
+		label = "LABEL_REPEATED"
+	case f.Label == "required":
+		label = "LABEL_REQUIRED"
+	}
+	d.printf("label: %s", label)
+	if strings.HasPrefix(f.Type, "map<") {
+		d.printf("type: TYPE_MESSAGE")
+		d.printf("type_name: %q", "."+scopedName(scope, mapEntryName(f.Name)))
+	} else {
+		d.fieldType(scope, f.Type)
+	}
+	jsonName := lowerCamel(f.Name)
+	opts := []*FieldOption{}
+	for _, o := range f.Options {
+		switch o.Name {
+		case "default":
+			v := o.Value
+			if u, err := strconv.Unquote(v); err == nil {
+				v = u
+			}
+			d.printf("default_value: %q", v)
+		case "json_name":
+			jsonName = strings.Trim(o.Value, `"`)
+		default:
+			opts = append(opts, o)
+		}
+	}
+	if oneof >= 0 {
+		d.printf("oneof_index: %d", oneof)
+	}
+	d.printf("json_name: %q", jsonName)
+	if len(opts) > 0 {
+		d.open("options")
+		for _, o := range opts {
+			if fieldOptionFields[o.Name] {
+				d.printf("%s: %s", o.Name, o.Value)
+			} else if feature := strings.TrimPrefix(o.Name, "features."); feature != o.Name {
+				d.printf("features { %s: %s }", feature, o.Value)
+			} else {
+				d.printf("# %s = %s", o.Name, o.Value)
+			}
+		}
+		d.close()
+	}
+	if d.proto3Optional(f) {
+		d.printf("proto3_optional: true")
+	}
+	d.close()
+}
+
+// fieldType writes the type of a field, resolving message and enum
+// names. Names which can't be resolved are written as they are without
+// a type, like protoc does before linking.
+func (d *descriptorWriter) fieldType(scope, t string) {
+	if dt, ok := descriptorTypes[t]; ok {
+		d.printf("type: %s", dt)
+		return
+	}
+	name, ok := resolveType(d.syms, scope, t)
+	if !ok {
+		d.printf("type_name: %q", t)
+		return
+	}
+	switch d.syms[name] {
+	case "message":
+		d.printf("type: TYPE_MESSAGE")
+	case "enum":
+		d.printf("type: TYPE_ENUM")
+	}
+	d.printf("type_name: %q", "."+name)
+}
+
+// mapEntry writes the nested message protoc generates for a map field
+func (d *descriptorWriter) mapEntry(scope string, f *Field) {
+	i := strings.Index(f.Type, ",")
+	key := strings.TrimSpace(f.Type[4:i])
+	value := strings.TrimSpace(f.Type[i+1 : len(f.Type)-1])
+	d.open("nested_type")
+	d.printf("name: %q", mapEntryName(f.Name))
+	for n, kv := range []string{"key", "value"} {
+		t := key
+		if kv == "value" {
+			t = value
+		}
+		d.open("field")
+		d.printf("name: %q", kv)
+		d.printf("number: %d", n+1)
+		d.printf("label: LABEL_OPTIONAL")
+		d.fieldType(scope, t)
+		d.printf("json_name: %q", kv)
+		d.close()
+	}
+	d.printf("options { map_entry: true }")
+	d.close()
+}
+
+func (d *descriptorWriter) enum(e *Enum) {
+	d.open("enum_type")
+	d.printf("name: %q", e.Name)
+	for _, n := range e.Body {
+		if v, ok := n.(*EnumValue); ok {
+			d.printf("value { name: %q number: %d }", v.Name, v.Number)
+		}
+	}
+	for _, n := range e.Body {
+		if o, ok := n.(*Option); ok && o.Name == "allow_alias" {
+			d.printf("options { allow_alias: %s }", o.Value)
+		}
+	}
+	for _, n := range e.Body {
+		if r, ok := n.(*Reserved); ok {
+			// unlike in messages, enum reserved ranges include their end
+			for _, rg := range r.Ranges {
+				d.printf("reserved_range { start: %d end: %d }", rg.Start, rangeEnd(rg, maxEnumNumber))
+			}
+			for _, name := range r.Names {
+				d.printf("reserved_name: %q", name)
+			}
+		}
+	}
+	d.close()
+}
+
+func (d *descriptorWriter) service(scope string, s *Service) {
+	d.open("service")
+	d.printf("name: %q", s.Name)
+	for _, n := range s.Body {
+		r, ok := n.(*RPC)
+		if !ok {
+			continue
+		}
+		d.open("method")
+		d.printf("name: %q", r.Name)
+		for _, t := range []string{"input_type", "output_type"} {
+			typ := r.Request
+			if t == "output_type" {
+				typ = r.Response
+			}
+			if name, ok := resolveType(d.syms, scope, typ); ok {
+				typ = "." + name
+			}
+			d.printf("%s: %q", t, typ)
+		}
+		if r.RequestStream {
+			d.printf("client_streaming: true")
+		}
+		if r.ResponseStream {
+			d.printf("server_streaming: true")
+		}
+		d.close()
+	}
+	d.close()
+}
+
+// rangeEnd returns the inclusive end of r, using max for `to max`
+func rangeEnd(r *Range, max int) int {
+	if r.Max {
+		return max
+	}
+	return r.End
+}
+
+// mapEntryName returns the name of the entry message for a map field,
+// e.g. FooBarEntry for foo_bar
+func mapEntryName(field string) string {
+	name := []rune(lowerCamel(field))
+	if len(name) > 0 {
+		name[0] = unicode.ToUpper(name[0])
+	}
+	return string(name) + "Entry"
+}
+
+// lowerCamel returns the JSON name protoc gives a field, e.g. fooBar for
+// foo_bar
+func lowerCamel(s string) string {
+	b := &strings.Builder{}
+	upper := false
+	for _, ch := range s {
+		switch {
+		case ch == '_':
+			upper = true
+		case upper:
+			b.WriteRune(unicode.ToUpper(ch))
+			upper = false
+		default:
+			b.WriteRune(ch)
+		}
+	}
+	return b.String()
+}
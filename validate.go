@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// validate checks the file for errors which protoc would reject
+func validate(f *File) []error {
+	errs := checkDuplicates(f.Body)
+	walk(f.Body, func(n node) {
+		if m, ok := n.(*Message); ok {
+			errs = append(errs, checkFieldNumbers(m)...)
+			errs = append(errs, checkReserved(m)...)
+			errs = append(errs, checkDuplicates(m.Body)...)
+		}
+		if e, ok := n.(*Enum); ok {
+			errs = append(errs, checkEnumReserved(e)...)
+		}
+		if err := checkName(n); err != nil {
+			errs = append(errs, err)
+		}
+	})
+	return errs
+}
+
+var identRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// protoKeywords are the words which protoc may read as keywords when
+// used as names
+var protoKeywords = map[string]bool{
+	"syntax": true, "import": true, "package": true, "option": true,
+	"message": true, "enum": true, "service": true, "rpc": true,
+	"returns": true, "stream": true, "oneof": true, "map": true,
+	"reserved": true, "extend": true, "extensions": true, "group": true,
+}
+
+// keywordWarnings returns a warning for each name in f which is a proto
+// keyword, since protoc may reject the output
+func keywordWarnings(f *File) []string {
+	warnings := []string{}
+	walk(f.Body, func(n node) {
+		name, line := nodeName(n)
+		if protoKeywords[name] {
+			warnings = append(warnings, fmt.Sprintf("line %d: %s name %s is a proto keyword, protoc may reject it",
+				line, n.kind(), name))
+		}
+	})
+	return warnings
+}
+
+// checkName checks that a declared name is a valid protobuf identifier
+func checkName(n node) error {
+	name, line := nodeName(n)
+	if line == 0 {
+		// not a declaration
+		return nil
+	}
+	if !identRegexp.MatchString(name) {
+		return fmt.Errorf("line %d: invalid %s name %q: must start with a letter or _ and contain only letters, digits and _",
+			line, n.kind(), name)
+	}
+	return nil
+}
+
+// checkDuplicates checks that no two messages, enums or services in the
+// same scope share a name
+func checkDuplicates(b body) []error {
+	errs := []error{}
+	type decl struct {
+		kind string
+		line int
+	}
+	seen := map[string]decl{}
+	for _, n := range b {
+		name, line := "", 0
+		switch n := n.(type) {
+		case *Message:
+			name, line = n.Name, n.line
+		case *Enum:
+			name, line = n.Name, n.line
+		case *Service:
+			name, line = n.Name, n.line
+		default:
+			continue
+		}
+		if prev, ok := seen[name]; ok {
+			errs = append(errs, fmt.Errorf("line %d: %s %s has the same name as the %s on line %d",
+				line, n.kind(), name, prev.kind, prev.line))
+			continue
+		}
+		seen[name] = decl{n.kind(), line}
+	}
+	return errs
+}
+
+// checkFieldNumbers checks that field numbers are in range and unique
+// within a message. Fields in a oneof share the number space of their
+// message.
+func checkFieldNumbers(m *Message) []error {
+	errs := []error{}
+	seen := map[int]*Field{}
+	check := func(f *Field) {
+		switch {
+		case f.Number < 1 || f.Number > maxFieldNumber:
+			errs = append(errs, fmt.Errorf("line %d: message %s: field %s has number %d, field numbers must be from 1 to %d",
+				f.line, m.Name, f.Name, f.Number, maxFieldNumber))
+			return
+		case f.Number >= 19000 && f.Number <= 19999:
+			errs = append(errs, fmt.Errorf("line %d: message %s: field %s uses number %d, 19000 to 19999 are reserved by protobuf",
+				f.line, m.Name, f.Name, f.Number))
+			return
+		}
+		if prev, ok := seen[f.Number]; ok {
+			errs = append(errs, fmt.Errorf("line %d: message %s: field %s reuses number %d of field %s on line %d",
+				f.line, m.Name, f.Name, f.Number, prev.Name, prev.line))
+			return
+		}
+		seen[f.Number] = f
+	}
+	for _, n := range m.Body {
+		switch n := n.(type) {
+		case *Field:
+			check(n)
+		case *Oneof:
+			for _, o := range n.Body {
+				if f, ok := o.(*Field); ok {
+					check(f)
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// checkReserved checks that no field in a message uses a reserved number
+// or name
+func checkReserved(m *Message) []error {
+	errs := []error{}
+	reserved := []*Reserved{}
+	fields := []*Field{}
+	for _, n := range m.Body {
+		switch n := n.(type) {
+		case *Reserved:
+			reserved = append(reserved, n)
+		case *Field:
+			fields = append(fields, n)
+		case *Oneof:
+			for _, o := range n.Body {
+				if f, ok := o.(*Field); ok {
+					fields = append(fields, f)
+				}
+			}
+		}
+	}
+	for _, f := range fields {
+		for _, r := range reserved {
+			for _, rg := range r.Ranges {
+				if rg.contains(f.Number) {
+					errs = append(errs, fmt.Errorf("line %d: message %s: field %s uses number %d, reserved by `reserved %s` on line %d",
+						f.line, m.Name, f.Name, f.Number, rg, r.line))
+				}
+			}
+			for _, name := range r.Names {
+				if name == f.Name {
+					errs = append(errs, fmt.Errorf("line %d: message %s: field name %s is reserved on line %d",
+						f.line, m.Name, f.Name, r.line))
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// checkEnumReserved checks that no value of an enum uses a reserved
+// number or name
+func checkEnumReserved(e *Enum) []error {
+	errs := []error{}
+	reserved := []*Reserved{}
+	for _, n := range e.Body {
+		if r, ok := n.(*Reserved); ok {
+			reserved = append(reserved, r)
+		}
+	}
+	for _, n := range e.Body {
+		v, ok := n.(*EnumValue)
+		if !ok {
+			continue
+		}
+		for _, r := range reserved {
+			for _, rg := range r.Ranges {
+				if rg.contains(v.Number) {
+					errs = append(errs, fmt.Errorf("line %d: enum %s: value %s uses number %d, reserved by `reserved %s` on line %d",
+						v.line, e.Name, v.Name, v.Number, rg, r.line))
+				}
+			}
+			for _, name := range r.Names {
+				if name == v.Name {
+					errs = append(errs, fmt.Errorf("line %d: enum %s: value name %s is reserved on line %d",
+						v.line, e.Name, v.Name, r.line))
+				}
+			}
+		}
+	}
+	return errs
+}